@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"errors"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -19,6 +20,23 @@ type Cache interface {
 	// Ping() error
 }
 
+// RawCache is implemented by caches that can report the TTL of a key and
+// store values without JSON encoding them, like the redis caches.
+// NewEncryptedCache needs it, Dump and Restore only keep TTLs with it.
+type RawCache interface {
+	Cache
+	// GetTTLByKey returns the remaining time to live of key, 0 when it has
+	// no expiration and redis.Nil when it doesn't exist.
+	GetTTLByKey(key string) (time.Duration, error)
+	CacheRawByKey(key string, val string, ex time.Duration)
+	// ReplaceRawByKey is CacheRawByKey for a key that exists, reporting
+	// whether it did. The check and the write are atomic.
+	ReplaceRawByKey(key string, val string, ex time.Duration) (bool, error)
+}
+
+// ErrNotRawCache is returned when a RawCache is needed but not given.
+var ErrNotRawCache = errors.New("cache does not implement RawCache")
+
 type CacheClient struct {
 	IsCluster     bool
 	Client        *redis.Client
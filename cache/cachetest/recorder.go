@@ -0,0 +1,549 @@
+// Package cachetest provides a recording cache.Cache for unit tests.
+package cachetest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/cache"
+	"github.com/go-redis/redis/v8"
+)
+
+// Method names recorded in Call.Method.
+const (
+	MethodCacheByKey                 = "CacheByKey"
+	MethodGetByKey                   = "GetByKey"
+	MethodGetTTLByKey                = "GetTTLByKey"
+	MethodCacheRawByKey              = "CacheRawByKey"
+	MethodReplaceRawByKey            = "ReplaceRawByKey"
+	MethodGetKeysByPattern           = "GetKeysByPattern"
+	MethodDeleteKey                  = "DeleteKey"
+	MethodBatchDeletionKeysByPattern = "BatchDeletionKeysByPattern"
+	MethodFlushDB                    = "FlushDB"
+	MethodFlushAll                   = "FlushAll"
+	MethodConnect                    = "Connect"
+	MethodGetClient                  = "GetClient"
+)
+
+// Call is a single recorded call on the Recorder.
+type Call struct {
+	Method string
+	// Key holds the key for key based methods and the pattern for
+	// pattern based methods.
+	Key   string
+	Value interface{}
+	TTL   time.Duration
+	Count int64
+	Err   error
+}
+
+func (c Call) String() string {
+	switch c.Method {
+	case MethodCacheByKey, MethodCacheRawByKey, MethodReplaceRawByKey:
+		return fmt.Sprintf("%s(%q, %v, %s)", c.Method, c.Key, c.Value, c.TTL)
+	case MethodGetKeysByPattern, MethodBatchDeletionKeysByPattern:
+		return fmt.Sprintf("%s(%q, %d)", c.Method, c.Key, c.Count)
+	case MethodFlushDB, MethodFlushAll, MethodGetClient:
+		return c.Method + "()"
+	}
+	return fmt.Sprintf("%s(%q)", c.Method, c.Key)
+}
+
+type entry struct {
+	val     string
+	expires time.Time
+}
+
+// Recorder is an in-memory cache.Cache that logs every call.
+// Values are stored JSON encoded like the redis implementations, and
+// scripted responses and errors can be set per key or pattern.
+// The zero value is ready to use.
+type Recorder struct {
+	// Now returns the current time, used for TTL expiry. Nil means time.Now.
+	Now func() time.Time
+
+	mu        sync.Mutex
+	calls     []Call
+	data      map[string]entry
+	responses []rule
+	errs      []rule
+}
+
+// rule is a scripted response or error for a key or pattern.
+type rule struct {
+	pattern string
+	val     string
+	err     error
+}
+
+var (
+	_ cache.RawCache         = (*Recorder)(nil)
+	_ cache.OperationApplier = (*Recorder)(nil)
+)
+
+// NewRecorder returns an empty Recorder using time.Now.
+func NewRecorder() *Recorder {
+	return &Recorder{Now: time.Now}
+}
+
+func (r *Recorder) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+// setRule adds or replaces the rule of pattern.
+func setRule(rules []rule, ru rule) []rule {
+	for i := range rules {
+		if rules[i].pattern == ru.pattern {
+			rules[i] = ru
+			return rules
+		}
+	}
+	return append(rules, ru)
+}
+
+func deleteRule(rules []rule, pattern string) []rule {
+	for i := range rules {
+		if rules[i].pattern == pattern {
+			return append(rules[:i], rules[i+1:]...)
+		}
+	}
+	return rules
+}
+
+// findRule returns the rule set for key itself or, failing that, the first
+// rule whose pattern matches key, in the order the rules were first set.
+func findRule(rules []rule, key string) (rule, bool) {
+	for _, ru := range rules {
+		if ru.pattern == key {
+			return ru, true
+		}
+	}
+	for _, ru := range rules {
+		if match(ru.pattern, key) {
+			return ru, true
+		}
+	}
+	return rule{}, false
+}
+
+// SetResponse makes GetByKey return val for the keys matching the given key
+// or pattern, regardless of the stored data.
+func (r *Recorder) SetResponse(keyOrPattern string, val string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responses = setRule(r.responses, rule{pattern: keyOrPattern, val: val})
+}
+
+// SetJSONResponse is like SetResponse but JSON encodes val first.
+func (r *Recorder) SetJSONResponse(keyOrPattern string, val interface{}) {
+	j, _ := json.Marshal(val)
+	r.SetResponse(keyOrPattern, string(j))
+}
+
+// ClearResponse removes a response set with SetResponse.
+func (r *Recorder) ClearResponse(keyOrPattern string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responses = deleteRule(r.responses, keyOrPattern)
+}
+
+// SetError makes every call on a key matching the given key or pattern
+// fail with err. Calls without a return value are recorded but have no effect.
+// When several patterns match, the one set first wins.
+func (r *Recorder) SetError(keyOrPattern string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs = setRule(r.errs, rule{pattern: keyOrPattern, err: err})
+}
+
+// ClearError removes an error set with SetError.
+func (r *Recorder) ClearError(keyOrPattern string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs = deleteRule(r.errs, keyOrPattern)
+}
+
+// Calls returns a copy of the recorded calls in order.
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := make([]Call, len(r.calls))
+	copy(calls, r.calls)
+	return calls
+}
+
+// CallsTo returns the recorded calls of the given method.
+func (r *Recorder) CallsTo(method string) []Call {
+	var calls []Call
+	for _, c := range r.Calls() {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Reset drops the recorded calls, stored data, responses and errors.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = nil
+	r.data = nil
+	r.responses = nil
+	r.errs = nil
+}
+
+// Keys returns the live stored keys in sorted order.
+func (r *Recorder) Keys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var keys []string
+	for k := range r.data {
+		if r.alive(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *Recorder) record(c Call) {
+	r.calls = append(r.calls, c)
+}
+
+// errFor returns the injected error for a key, see findRule.
+func (r *Recorder) errFor(key string) error {
+	ru, _ := findRule(r.errs, key)
+	return ru.err
+}
+
+// store saves e under key, allocating the data map of a zero Recorder.
+func (r *Recorder) store(key string, e entry) {
+	if r.data == nil {
+		r.data = map[string]entry{}
+	}
+	r.data[key] = e
+}
+
+// alive reports whether key is stored and not expired, dropping it if expired.
+func (r *Recorder) alive(key string) bool {
+	e, ok := r.data[key]
+	if !ok {
+		return false
+	}
+	if !e.expires.IsZero() && !r.now().Before(e.expires) {
+		delete(r.data, key)
+		return false
+	}
+	return true
+}
+
+func (r *Recorder) Connect(uri string, password string, db int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.errFor(uri)
+	r.record(Call{Method: MethodConnect, Key: uri, Err: err})
+	return err
+}
+
+func (r *Recorder) GetClient() (*cache.CacheClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := errors.New("no client")
+	r.record(Call{Method: MethodGetClient, Err: err})
+	return nil, err
+}
+
+func (r *Recorder) CacheByKey(key string, val interface{}, ex time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.errFor(key)
+	r.record(Call{Method: MethodCacheByKey, Key: key, Value: val, TTL: ex, Err: err})
+	if err != nil {
+		return
+	}
+	j, _ := json.Marshal(val)
+	e := entry{val: string(j)}
+	if ex > 0 {
+		e.expires = r.now().Add(ex)
+	}
+	r.store(key, e)
+}
+
+func (r *Recorder) GetByKey(key string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.errFor(key); err != nil {
+		r.record(Call{Method: MethodGetByKey, Key: key, Err: err})
+		return "", err
+	}
+	if ru, ok := findRule(r.responses, key); ok {
+		r.record(Call{Method: MethodGetByKey, Key: key, Value: ru.val})
+		return ru.val, nil
+	}
+	if !r.alive(key) {
+		r.record(Call{Method: MethodGetByKey, Key: key, Err: redis.Nil})
+		return "", redis.Nil
+	}
+	val := r.data[key].val
+	r.record(Call{Method: MethodGetByKey, Key: key, Value: val})
+	return val, nil
+}
+
+func (r *Recorder) CacheRawByKey(key string, val string, ex time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.errFor(key)
+	r.record(Call{Method: MethodCacheRawByKey, Key: key, Value: val, TTL: ex, Err: err})
+	if err != nil {
+		return
+	}
+	e := entry{val: val}
+	if ex > 0 {
+		e.expires = r.now().Add(ex)
+	}
+	r.store(key, e)
+}
+
+func (r *Recorder) ReplaceRawByKey(key string, val string, ex time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.errFor(key)
+	r.record(Call{Method: MethodReplaceRawByKey, Key: key, Value: val, TTL: ex, Err: err})
+	if err != nil || !r.alive(key) {
+		return false, err
+	}
+	e := entry{val: val}
+	if ex > 0 {
+		e.expires = r.now().Add(ex)
+	}
+	r.store(key, e)
+	return true, nil
+}
+
+func (r *Recorder) GetTTLByKey(key string) (time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.errFor(key); err != nil {
+		r.record(Call{Method: MethodGetTTLByKey, Key: key, Err: err})
+		return 0, err
+	}
+	if !r.alive(key) {
+		r.record(Call{Method: MethodGetTTLByKey, Key: key, Err: redis.Nil})
+		return 0, redis.Nil
+	}
+	var ttl time.Duration
+	if e := r.data[key]; !e.expires.IsZero() {
+		ttl = e.expires.Sub(r.now())
+	}
+	r.record(Call{Method: MethodGetTTLByKey, Key: key, TTL: ttl})
+	return ttl, nil
+}
+
+func (r *Recorder) GetKeysByPattern(key string, count int64) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.errFor(key); err != nil {
+		r.record(Call{Method: MethodGetKeysByPattern, Key: key, Count: count, Err: err})
+		return nil, err
+	}
+	r.record(Call{Method: MethodGetKeysByPattern, Key: key, Count: count})
+	result := []string{}
+	for k := range r.data {
+		if r.alive(k) && match(key, k) {
+			result = append(result, k)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (r *Recorder) DeleteKey(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.errFor(key)
+	r.record(Call{Method: MethodDeleteKey, Key: key, Err: err})
+	if err != nil {
+		return
+	}
+	delete(r.data, key)
+}
+
+func (r *Recorder) BatchDeletionKeysByPattern(key string, count int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.errFor(key)
+	r.record(Call{Method: MethodBatchDeletionKeysByPattern, Key: key, Count: count, Err: err})
+	if err != nil {
+		return
+	}
+	for k := range r.data {
+		if match(key, k) {
+			delete(r.data, k)
+		}
+	}
+}
+
+func (r *Recorder) FlushDB() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(Call{Method: MethodFlushDB})
+	r.data = nil
+}
+
+func (r *Recorder) FlushAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(Call{Method: MethodFlushAll})
+	r.data = nil
+}
+
+// Apply runs the write operation op and returns the error injected for its
+// key, so hooked caches see write failures. Flushes never fail.
+func (r *Recorder) Apply(op *cache.Operation) error {
+	switch op.Name {
+	case cache.OpSet:
+		r.CacheByKey(op.Key, op.Value, op.TTL)
+	case cache.OpSetRaw:
+		raw, _ := op.Value.(string)
+		r.CacheRawByKey(op.Key, raw, op.TTL)
+	case cache.OpDelete:
+		r.DeleteKey(op.Key)
+	case cache.OpDeletePattern:
+		r.BatchDeletionKeysByPattern(op.Key, op.Count)
+	case cache.OpFlushDB:
+		r.FlushDB()
+		return nil
+	case cache.OpFlushAll:
+		r.FlushAll()
+		return nil
+	default:
+		return fmt.Errorf("unsupported cache operation %q", op.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.errFor(op.Key)
+}
+
+func (r *Recorder) sets() []Call {
+	var calls []Call
+	for _, c := range r.Calls() {
+		if c.Method == MethodCacheByKey || c.Method == MethodCacheRawByKey {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// ExpectKeySet fails the test unless key was set.
+func (r *Recorder) ExpectKeySet(t testing.TB, key string) Call {
+	t.Helper()
+	for _, c := range r.sets() {
+		if c.Key == key {
+			return c
+		}
+	}
+	t.Errorf("cachetest: expected key %q to be set\n%s", key, r.dump())
+	return Call{}
+}
+
+// ExpectKeySetWithTTL fails the test unless key was set with the given expiration.
+func (r *Recorder) ExpectKeySetWithTTL(t testing.TB, key string, ttl time.Duration) Call {
+	t.Helper()
+	for _, c := range r.sets() {
+		if c.Key == key && c.TTL == ttl {
+			return c
+		}
+	}
+	t.Errorf("cachetest: expected key %q to be set with ttl %s\n%s", key, ttl, r.dump())
+	return Call{}
+}
+
+// ExpectKeyValue fails the test unless key is stored and its JSON encoding
+// equals the encoding of val.
+func (r *Recorder) ExpectKeyValue(t testing.TB, key string, val interface{}) {
+	t.Helper()
+	want, _ := json.Marshal(val)
+	r.mu.Lock()
+	alive := r.alive(key)
+	got := r.data[key].val
+	r.mu.Unlock()
+	if !alive {
+		t.Errorf("cachetest: expected key %q to be stored\n%s", key, r.dump())
+		return
+	}
+	if got != string(want) {
+		t.Errorf("cachetest: key %q holds %s, want %s", key, got, want)
+	}
+}
+
+// ExpectKeyNotSet fails the test if key was set.
+func (r *Recorder) ExpectKeyNotSet(t testing.TB, key string) {
+	t.Helper()
+	for _, c := range r.sets() {
+		if c.Key == key {
+			t.Errorf("cachetest: expected key %q not to be set, got %s", key, c)
+			return
+		}
+	}
+}
+
+// ExpectKeyDeleted fails the test unless DeleteKey was called for key.
+func (r *Recorder) ExpectKeyDeleted(t testing.TB, key string) {
+	t.Helper()
+	for _, c := range r.CallsTo(MethodDeleteKey) {
+		if c.Key == key {
+			return
+		}
+	}
+	t.Errorf("cachetest: expected key %q to be deleted\n%s", key, r.dump())
+}
+
+// ExpectPatternDeleted fails the test unless BatchDeletionKeysByPattern
+// was called with pattern.
+func (r *Recorder) ExpectPatternDeleted(t testing.TB, pattern string) {
+	t.Helper()
+	for _, c := range r.CallsTo(MethodBatchDeletionKeysByPattern) {
+		if c.Key == pattern {
+			return
+		}
+	}
+	t.Errorf("cachetest: expected pattern %q to be deleted\n%s", pattern, r.dump())
+}
+
+// ExpectCalled fails the test unless method was called n times.
+func (r *Recorder) ExpectCalled(t testing.TB, method string, n int) {
+	t.Helper()
+	if got := len(r.CallsTo(method)); got != n {
+		t.Errorf("cachetest: expected %d calls to %s, got %d\n%s", n, method, got, r.dump())
+	}
+}
+
+// ExpectNoCalls fails the test if any call was recorded.
+func (r *Recorder) ExpectNoCalls(t testing.TB) {
+	t.Helper()
+	if len(r.Calls()) != 0 {
+		t.Errorf("cachetest: expected no calls\n%s", r.dump())
+	}
+}
+
+func (r *Recorder) dump() string {
+	calls := r.Calls()
+	if len(calls) == 0 {
+		return "no calls recorded"
+	}
+	lines := make([]string, len(calls))
+	for i, c := range calls {
+		lines[i] = fmt.Sprintf("  %d: %s", i, c)
+	}
+	return "recorded calls:\n" + strings.Join(lines, "\n")
+}
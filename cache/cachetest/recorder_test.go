@@ -0,0 +1,82 @@
+package cachetest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestZeroRecorder(t *testing.T) {
+	var r Recorder
+	if _, err := r.GetByKey("a"); err != redis.Nil {
+		t.Fatalf("GetByKey on empty recorder: %v, want redis.Nil", err)
+	}
+	r.CacheByKey("a", 1, 0)
+	r.ExpectKeyValue(t, "a", 1)
+	r.SetError("b*", errors.New("boom"))
+	r.SetResponse("c*", "x")
+	r.Reset()
+	r.CacheRawByKey("b", "raw", time.Minute)
+	if got, err := r.GetByKey("b"); err != nil || got != "raw" {
+		t.Fatalf("GetByKey after Reset = %q, %v", got, err)
+	}
+}
+
+func TestRecorderErrorPrecedence(t *testing.T) {
+	first := errors.New("first")
+	second := errors.New("second")
+	exact := errors.New("exact")
+
+	r := NewRecorder()
+	r.SetError("user:*", first)
+	r.SetError("user:1*", second)
+	for i := 0; i < 20; i++ {
+		if _, err := r.GetByKey("user:12"); err != first {
+			t.Fatalf("GetByKey(user:12) = %v, want the pattern set first", err)
+		}
+	}
+	r.SetError("user:12", exact)
+	if _, err := r.GetByKey("user:12"); err != exact {
+		t.Fatalf("GetByKey(user:12) = %v, want the exact key error", err)
+	}
+	r.ClearError("user:*")
+	r.ClearError("user:12")
+	if _, err := r.GetByKey("user:12"); err != second {
+		t.Fatalf("GetByKey(user:12) = %v, want the remaining pattern", err)
+	}
+}
+
+func TestRecorderPatternResponse(t *testing.T) {
+	r := NewRecorder()
+	r.SetJSONResponse("session:*", map[string]string{"id": "s"})
+	r.SetResponse("session:admin", "admin")
+
+	if got, _ := r.GetByKey("session:42"); got != `{"id":"s"}` {
+		t.Errorf("GetByKey(session:42) = %q", got)
+	}
+	if got, _ := r.GetByKey("session:admin"); got != "admin" {
+		t.Errorf("GetByKey(session:admin) = %q", got)
+	}
+	r.ClearResponse("session:*")
+	if _, err := r.GetByKey("session:42"); err != redis.Nil {
+		t.Errorf("GetByKey after ClearResponse: %v, want redis.Nil", err)
+	}
+}
+
+func TestRecorderExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewRecorder()
+	r.Now = func() time.Time { return now }
+	r.CacheByKey("k", "v", time.Second)
+	if ttl, err := r.GetTTLByKey("k"); err != nil || ttl != time.Second {
+		t.Fatalf("GetTTLByKey = %s, %v", ttl, err)
+	}
+	now = now.Add(time.Second)
+	if _, err := r.GetByKey("k"); err != redis.Nil {
+		t.Fatalf("GetByKey after expiry: %v, want redis.Nil", err)
+	}
+	r.ExpectKeySetWithTTL(t, "k", time.Second)
+	r.ExpectCalled(t, MethodGetByKey, 1)
+}
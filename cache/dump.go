@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DumpRecord is a single key in a dump, written as one JSON line.
+type DumpRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Expires is when the key expires in Unix milliseconds, 0 for no
+	// expiration.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// Dump writes every key matching pattern with its value and expiry to w as
+// JSON lines and returns the number of keys written. Keys that expire
+// between the scan and the read are skipped. Only a RawCache reports TTLs,
+// the keys of other caches are dumped without expiration.
+//
+// Only string keys are supported: the cluster cache only scans string keys,
+// and other types fail with a WRONGTYPE error on a single node.
+func Dump(c Cache, pattern string, count int64, w io.Writer) (int, error) {
+	rc, raw := c.(RawCache)
+	keys, err := c.GetKeysByPattern(pattern, count)
+	if err != nil {
+		return 0, err
+	}
+
+	enc := json.NewEncoder(w)
+	n := 0
+	for _, key := range keys {
+		var ttl time.Duration
+		if raw {
+			ttl, err = rc.GetTTLByKey(key)
+			if err == redis.Nil {
+				continue
+			}
+			if err == ErrNotRawCache {
+				// a hooked cache wrapping another Cache
+				raw, ttl = false, 0
+			} else if err != nil {
+				return n, fmt.Errorf("dump %s: %v", key, err)
+			}
+		}
+		val, err := c.GetByKey(key)
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return n, fmt.Errorf("dump %s: %v", key, err)
+		}
+		rec := DumpRecord{Key: key, Value: val}
+		if ttl > 0 {
+			// round up, a TTL under 1ms must not expire before it is written
+			rec.Expires = (time.Now().Add(ttl).UnixNano() + int64(time.Millisecond) - 1) / int64(time.Millisecond)
+		}
+		if err := enc.Encode(rec); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Restore reads JSON lines written by Dump from r and stores them in c with
+// the time they had left to live, skipping keys that already expired. A
+// RawCache gets the values as they were dumped, other caches get them as
+// JSON. It returns the number of keys restored and stops at the first write
+// error, which only caches implementing OperationApplier report.
+func Restore(c Cache, r io.Reader) (int, error) {
+	_, raw := c.(RawCache)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 512*1024*1024)
+	n := 0
+	line := 0
+	for sc.Scan() {
+		line++
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rec DumpRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return n, fmt.Errorf("restore line %d: %v", line, err)
+		}
+		if rec.Key == "" {
+			return n, fmt.Errorf("restore line %d: empty key", line)
+		}
+		var ttl time.Duration
+		if rec.Expires != 0 {
+			ttl = time.Until(time.Unix(0, rec.Expires*int64(time.Millisecond)))
+			if ttl <= 0 {
+				continue
+			}
+		}
+		err := ErrNotRawCache
+		if raw {
+			err = apply(c, &Operation{Name: OpSetRaw, Key: rec.Key, Value: rec.Value, TTL: ttl})
+		}
+		if err == ErrNotRawCache {
+			// not a RawCache, or a hooked cache wrapping another Cache
+			raw = false
+			err = apply(c, &Operation{Name: OpSet, Key: rec.Key, Value: json.RawMessage(rec.Value), TTL: ttl})
+		}
+		if err != nil {
+			return n, fmt.Errorf("restore %s: %v", rec.Key, err)
+		}
+		n++
+	}
+	return n, sc.Err()
+}
@@ -0,0 +1,162 @@
+package cache_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/cache"
+	"github.com/ahmadIte99/hamdan_common/cache/cachetest"
+)
+
+// plainCache hides the RawCache methods of a Recorder.
+type plainCache struct{ cache.Cache }
+
+func dumpRecords(t *testing.T, buf *bytes.Buffer) []cache.DumpRecord {
+	t.Helper()
+	var recs []cache.DumpRecord
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec cache.DumpRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// expectTTL fails the test unless key was last set with a TTL in (min, max].
+func expectTTL(t *testing.T, rec *cachetest.Recorder, key string, min time.Duration, max time.Duration) {
+	t.Helper()
+	var ttl time.Duration
+	found := false
+	for _, c := range rec.Calls() {
+		if c.Key == key && (c.Method == cachetest.MethodCacheByKey || c.Method == cachetest.MethodCacheRawByKey) {
+			ttl, found = c.TTL, true
+		}
+	}
+	if !found || ttl <= min || ttl > max {
+		t.Errorf("%s: got ttl %s (set %v), want in (%s, %s]", key, ttl, found, min, max)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	src := cachetest.NewRecorder()
+	src.CacheByKey("a", map[string]int{"n": 1}, 0)
+	src.CacheRawByKey("b", "raw", time.Minute)
+	src.CacheByKey("other", "x", 0)
+
+	var buf bytes.Buffer
+	before := time.Now()
+	n, err := cache.Dump(src, "[ab]", 10, &buf)
+	if err != nil || n != 2 {
+		t.Fatalf("Dump = %d, %v", n, err)
+	}
+
+	recs := dumpRecords(t, &buf)
+	if recs[0] != (cache.DumpRecord{Key: "a", Value: `{"n":1}`}) {
+		t.Errorf("record 0 = %+v", recs[0])
+	}
+	expires := time.Unix(0, recs[1].Expires*int64(time.Millisecond))
+	if recs[1].Key != "b" || recs[1].Value != "raw" ||
+		expires.Before(before.Add(time.Minute-time.Second)) || expires.After(time.Now().Add(time.Minute+time.Millisecond)) {
+		t.Errorf("record 1 = %+v, expires %s", recs[1], expires)
+	}
+
+	dst := cachetest.NewRecorder()
+	n, err = cache.Restore(dst, &buf)
+	if err != nil || n != 2 {
+		t.Fatalf("Restore = %d, %v", n, err)
+	}
+	dst.ExpectKeySetWithTTL(t, "a", 0)
+	expectTTL(t, dst, "b", time.Minute-time.Second, time.Minute+time.Millisecond)
+	dst.ExpectKeyValue(t, "a", map[string]int{"n": 1})
+}
+
+func TestRestoreRemainingTTL(t *testing.T) {
+	now := time.Now()
+	ms := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+	dump := strings.Join([]string{
+		`{"key":"expired","value":"x","expires":` + jsonInt(ms(now.Add(-time.Second))) + `}`,
+		`{"key":"later","value":"x","expires":` + jsonInt(ms(now.Add(time.Hour))) + `}`,
+		`{"key":"forever","value":"x"}`,
+	}, "\n")
+
+	dst := cachetest.NewRecorder()
+	n, err := cache.Restore(dst, strings.NewReader(dump))
+	if err != nil || n != 2 {
+		t.Fatalf("Restore = %d, %v", n, err)
+	}
+	dst.ExpectKeyNotSet(t, "expired")
+	expectTTL(t, dst, "later", time.Hour-time.Minute, time.Hour)
+	dst.ExpectKeySetWithTTL(t, "forever", 0)
+}
+
+func jsonInt(n int64) string {
+	j, _ := json.Marshal(n)
+	return string(j)
+}
+
+func TestRestoreBadLine(t *testing.T) {
+	_, err := cache.Restore(cachetest.NewRecorder(), strings.NewReader("{\"key\":\"a\"}\nnot json\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("Restore error = %v, want line 2", err)
+	}
+}
+
+func TestRestoreWriteError(t *testing.T) {
+	fail := errors.New("write failed")
+	dst := cachetest.NewRecorder()
+	dst.SetError("b", fail)
+
+	n, err := cache.Restore(dst, strings.NewReader(`{"key":"a","value":"1"}`+"\n"+`{"key":"b","value":"2"}`+"\n"+`{"key":"c","value":"3"}`))
+	if n != 1 || err == nil || !strings.Contains(err.Error(), fail.Error()) {
+		t.Fatalf("Restore = %d, %v, want 1 and the write error", n, err)
+	}
+	dst.ExpectKeyNotSet(t, "c")
+}
+
+func TestDumpRestorePlainCache(t *testing.T) {
+	rec := cachetest.NewRecorder()
+	rec.CacheByKey("a", map[string]int{"n": 1}, time.Minute)
+	src := plainCache{rec}
+
+	var buf bytes.Buffer
+	n, err := cache.Dump(src, "*", 10, &buf)
+	if err != nil || n != 1 {
+		t.Fatalf("Dump = %d, %v", n, err)
+	}
+	if recs := dumpRecords(t, &buf); recs[0] != (cache.DumpRecord{Key: "a", Value: `{"n":1}`}) {
+		t.Errorf("record = %+v", recs[0])
+	}
+
+	dstRec := cachetest.NewRecorder()
+	n, err = cache.Restore(plainCache{dstRec}, &buf)
+	if err != nil || n != 1 {
+		t.Fatalf("Restore = %d, %v", n, err)
+	}
+	dstRec.ExpectKeyValue(t, "a", map[string]int{"n": 1})
+	for _, c := range dstRec.Calls() {
+		if c.Method == cachetest.MethodCacheRawByKey {
+			t.Errorf("unexpected raw write %v", c)
+		}
+	}
+}
+
+func TestDumpRestoreHookedPlainCache(t *testing.T) {
+	rec := cachetest.NewRecorder()
+	rec.CacheByKey("a", 1, 0)
+
+	var buf bytes.Buffer
+	if n, err := cache.Dump(cache.NewHookedCache(plainCache{rec}), "*", 10, &buf); err != nil || n != 1 {
+		t.Fatalf("Dump = %d, %v", n, err)
+	}
+	dst := cachetest.NewRecorder()
+	if n, err := cache.Restore(cache.NewHookedCache(plainCache{dst}), &buf); err != nil || n != 1 {
+		t.Fatalf("Restore = %d, %v", n, err)
+	}
+	dst.ExpectKeyValue(t, "a", 1)
+}
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/ahmadIte99/hamdan_common/logging"
+)
+
+// encryptedPrefix marks encrypted values: "enc:v1:<key id>:<base64 nonce+ciphertext>".
+const encryptedPrefix = "enc:v1:"
+
+// EncryptionKeys holds AES keys by id. Values are encrypted with the
+// Current key and decrypted with whichever key id is in the payload, so
+// old keys can be kept around while rotating.
+type EncryptionKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k *EncryptionKeys) aead(id string) (cipher.AEAD, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type encryptedCache struct {
+	RawCache
+	keys     *EncryptionKeys
+	prefixes []string
+}
+
+// NewEncryptedCache wraps c so values of keys starting with one of prefixes
+// are stored encrypted with AES-GCM. With no prefixes every key is encrypted.
+// Values that fail to decrypt are reported as misses (redis.Nil).
+// c must be a RawCache.
+func NewEncryptedCache(c Cache, keys *EncryptionKeys, prefixes ...string) (RawCache, error) {
+	rc, ok := c.(RawCache)
+	if !ok {
+		return nil, ErrNotRawCache
+	}
+	if keys == nil {
+		return nil, errors.New("no encryption keys")
+	}
+	for id := range keys.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("encryption key id %q must be non empty and not contain ':'", id)
+		}
+		if _, err := keys.aead(id); err != nil {
+			return nil, fmt.Errorf("encryption key %q: %v", id, err)
+		}
+	}
+	if _, err := keys.aead(keys.Current); err != nil {
+		return nil, err
+	}
+	return &encryptedCache{RawCache: rc, keys: keys, prefixes: prefixes}, nil
+}
+
+func (e *encryptedCache) sensitive(key string) bool {
+	if len(e.prefixes) == 0 {
+		return true
+	}
+	for _, p := range e.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *encryptedCache) encrypt(key string, plain []byte) (string, error) {
+	aead, err := e.keys.aead(e.keys.Current)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	// the cache key is authenticated so values can't be swapped between keys
+	sealed := aead.Seal(nonce, nonce, plain, []byte(key))
+	return encryptedPrefix + e.keys.Current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (e *encryptedCache) decrypt(key string, val string) (string, error) {
+	if !strings.HasPrefix(val, encryptedPrefix) {
+		return "", errors.New("value is not encrypted")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(val, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("malformed encrypted value")
+	}
+	aead, err := e.keys.aead(parts[0])
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func (e *encryptedCache) CacheByKey(key string, val interface{}, ex time.Duration) {
+	if !e.sensitive(key) {
+		e.RawCache.CacheByKey(key, val, ex)
+		return
+	}
+	j, err := json.Marshal(val)
+	if err != nil {
+		return
+	}
+	enc, err := e.encrypt(key, j)
+	if err != nil {
+		logging.Error("cache encrypt failed", "key", key, "err", err)
+		return
+	}
+	e.RawCache.CacheRawByKey(key, enc, ex)
+}
+
+// CacheRawByKey encrypts val like CacheByKey, whatever it holds. Values
+// dumped through the encrypted cache are plaintext and get encrypted again
+// on Restore; ciphertext is copied with the underlying cache instead.
+func (e *encryptedCache) CacheRawByKey(key string, val string, ex time.Duration) {
+	if !e.sensitive(key) {
+		e.RawCache.CacheRawByKey(key, val, ex)
+		return
+	}
+	enc, err := e.encrypt(key, []byte(val))
+	if err != nil {
+		logging.Error("cache encrypt failed", "key", key, "err", err)
+		return
+	}
+	e.RawCache.CacheRawByKey(key, enc, ex)
+}
+
+// ReplaceRawByKey encrypts val like CacheRawByKey.
+func (e *encryptedCache) ReplaceRawByKey(key string, val string, ex time.Duration) (bool, error) {
+	if !e.sensitive(key) {
+		return e.RawCache.ReplaceRawByKey(key, val, ex)
+	}
+	enc, err := e.encrypt(key, []byte(val))
+	if err != nil {
+		return false, err
+	}
+	return e.RawCache.ReplaceRawByKey(key, enc, ex)
+}
+
+func (e *encryptedCache) GetByKey(key string) (string, error) {
+	val, err := e.RawCache.GetByKey(key)
+	if err != nil || !e.sensitive(key) {
+		return val, err
+	}
+	plain, err := e.decrypt(key, val)
+	if err != nil {
+		logging.Warn("cache decrypt failed", "key", key, "err", err)
+		return "", redis.Nil
+	}
+	return plain, nil
+}
+
+// Apply encrypts the values of set and setRaw operations on sensitive keys
+// and runs op on the underlying cache, see OperationApplier.
+func (e *encryptedCache) Apply(op *Operation) error {
+	if (op.Name == OpSet || op.Name == OpSetRaw) && e.sensitive(op.Key) {
+		var plain []byte
+		if op.Name == OpSet {
+			j, err := json.Marshal(op.Value)
+			if err != nil {
+				return err
+			}
+			plain = j
+		} else {
+			raw, _ := op.Value.(string)
+			plain = []byte(raw)
+		}
+		enc, err := e.encrypt(op.Key, plain)
+		if err != nil {
+			return err
+		}
+		return apply(e.RawCache, &Operation{Name: OpSetRaw, Key: op.Key, Value: enc, TTL: op.TTL})
+	}
+	return apply(e.RawCache, op)
+}
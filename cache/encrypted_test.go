@@ -0,0 +1,87 @@
+package cache_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ahmadIte99/hamdan_common/cache"
+	"github.com/ahmadIte99/hamdan_common/cache/cachetest"
+	"github.com/go-redis/redis/v8"
+)
+
+func testKeys() *cache.EncryptionKeys {
+	return &cache.EncryptionKeys{Current: "k2", Keys: map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	}}
+}
+
+func TestEncryptedCacheRoundTrip(t *testing.T) {
+	rec := cachetest.NewRecorder()
+	c, err := cache.NewEncryptedCache(rec, testKeys(), "secret:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.CacheByKey("secret:a", map[string]string{"card": "4111"}, 0)
+	c.CacheRawByKey("secret:b", "enc:v1:looks-encrypted", 0)
+	c.CacheRawByKey("public:c", "plain", 0)
+
+	stored, _ := rec.GetByKey("secret:a")
+	if !strings.HasPrefix(stored, "enc:v1:k2:") || strings.Contains(stored, "4111") {
+		t.Fatalf("stored value %q is not encrypted with the current key", stored)
+	}
+	if got, err := c.GetByKey("secret:a"); err != nil || got != `{"card":"4111"}` {
+		t.Errorf("GetByKey(secret:a) = %q, %v", got, err)
+	}
+	if stored, _ := rec.GetByKey("secret:b"); !strings.HasPrefix(stored, "enc:v1:k2:") {
+		t.Errorf("value with the encrypted prefix stored as %q", stored)
+	}
+	if got, err := c.GetByKey("secret:b"); err != nil || got != "enc:v1:looks-encrypted" {
+		t.Errorf("GetByKey(secret:b) = %q, %v", got, err)
+	}
+	if stored, _ := rec.GetByKey("public:c"); stored != "plain" {
+		t.Errorf("non sensitive value stored as %q", stored)
+	}
+}
+
+func TestEncryptedCacheRejectsSwappedValues(t *testing.T) {
+	rec := cachetest.NewRecorder()
+	c, _ := cache.NewEncryptedCache(rec, testKeys())
+	c.CacheByKey("a", "one", 0)
+	stored, _ := rec.GetByKey("a")
+	rec.CacheRawByKey("b", stored, 0)
+	if _, err := c.GetByKey("b"); err != redis.Nil {
+		t.Errorf("GetByKey of a value copied from another key: %v, want redis.Nil", err)
+	}
+}
+
+func TestEncryptedCacheRotation(t *testing.T) {
+	rec := cachetest.NewRecorder()
+	old := testKeys()
+	old.Current = "k1"
+	c1, _ := cache.NewEncryptedCache(rec, old)
+	c1.CacheByKey("a", "v", 0)
+
+	c2, _ := cache.NewEncryptedCache(rec, testKeys())
+	if got, err := c2.GetByKey("a"); err != nil || got != `"v"` {
+		t.Errorf("GetByKey with a rotated key = %q, %v", got, err)
+	}
+}
+
+func TestEncryptedCacheKeyIds(t *testing.T) {
+	for _, id := range []string{"", "a:b"} {
+		keys := &cache.EncryptionKeys{Current: "ok", Keys: map[string][]byte{
+			"ok": bytes.Repeat([]byte{1}, 32),
+			id:   bytes.Repeat([]byte{2}, 32),
+		}}
+		if _, err := cache.NewEncryptedCache(cachetest.NewRecorder(), keys); err == nil {
+			t.Errorf("key id %q accepted", id)
+		}
+	}
+	keys := testKeys()
+	keys.Current = "missing"
+	if _, err := cache.NewEncryptedCache(cachetest.NewRecorder(), keys); err == nil {
+		t.Error("missing current key accepted")
+	}
+}
@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// Operation names passed to hooks.
+const (
+	OpSet           = "set"
+	OpSetRaw        = "setRaw"
+	OpReplaceRaw    = "replaceRaw"
+	OpGet           = "get"
+	OpGetTTL        = "getTTL"
+	OpScan          = "scan"
+	OpDelete        = "delete"
+	OpDeletePattern = "deletePattern"
+	OpFlushDB       = "flushDB"
+	OpFlushAll      = "flushAll"
+)
+
+// Operation describes a cache call going through a hooked cache.
+// Before hooks may modify Key, Value and TTL; after hooks may modify
+// Result, Keys and Err of read operations. Result is "OK" after a
+// replaceRaw operation that found its key.
+type Operation struct {
+	Name string
+	// Key is the key, or the pattern for scan and deletePattern.
+	Key   string
+	Value interface{}
+	TTL   time.Duration
+	Count int64
+
+	Result string
+	Keys   []string
+	Err    error
+}
+
+// Hook is called around every cache operation. Returning an error from
+// BeforeOperation vetoes the operation: it is not executed, the hooks after
+// the vetoing one are skipped and, for read operations, the error is returned
+// to the caller. AfterOperation is called on the hooks whose BeforeOperation
+// succeeded, with Err set to the veto or operation error. Write errors are
+// only known for caches implementing OperationApplier.
+type Hook interface {
+	BeforeOperation(op *Operation) error
+	AfterOperation(op *Operation)
+}
+
+// HookFuncs adapts plain functions to a Hook, nil fields are skipped.
+type HookFuncs struct {
+	Before func(op *Operation) error
+	After  func(op *Operation)
+}
+
+func (h HookFuncs) BeforeOperation(op *Operation) error {
+	if h.Before == nil {
+		return nil
+	}
+	return h.Before(op)
+}
+
+func (h HookFuncs) AfterOperation(op *Operation) {
+	if h.After != nil {
+		h.After(op)
+	}
+}
+
+// OperationApplier is implemented by caches that report the error of a
+// write. Apply runs op, one of the set, setRaw, delete, deletePattern,
+// flushDB and flushAll operations, and returns its error.
+type OperationApplier interface {
+	Apply(op *Operation) error
+}
+
+// apply runs the write operation op on c, through Apply when c implements
+// OperationApplier. Other caches can't report write errors.
+func apply(c Cache, op *Operation) error {
+	if a, ok := c.(OperationApplier); ok {
+		return a.Apply(op)
+	}
+	switch op.Name {
+	case OpSet:
+		c.CacheByKey(op.Key, op.Value, op.TTL)
+	case OpSetRaw:
+		rc, ok := c.(RawCache)
+		if !ok {
+			return ErrNotRawCache
+		}
+		raw, _ := op.Value.(string)
+		rc.CacheRawByKey(op.Key, raw, op.TTL)
+	case OpDelete:
+		c.DeleteKey(op.Key)
+	case OpDeletePattern:
+		c.BatchDeletionKeysByPattern(op.Key, op.Count)
+	case OpFlushDB:
+		c.FlushDB()
+	case OpFlushAll:
+		c.FlushAll()
+	default:
+		return fmt.Errorf("unsupported cache operation %q", op.Name)
+	}
+	return nil
+}
+
+type hookedCache struct {
+	Cache
+	hooks []Hook
+}
+
+// NewHookedCache wraps c so every operation runs through hooks, in order
+// for BeforeOperation and in reverse order for AfterOperation. The result is
+// a RawCache whose raw operations fail with ErrNotRawCache when c isn't one.
+func NewHookedCache(c Cache, hooks ...Hook) Cache {
+	return &hookedCache{Cache: c, hooks: hooks}
+}
+
+// before runs the BeforeOperation hooks until one vetoes op and returns
+// how many succeeded.
+func (h *hookedCache) before(op *Operation) int {
+	for i, hook := range h.hooks {
+		if err := hook.BeforeOperation(op); err != nil {
+			op.Err = err
+			return i
+		}
+	}
+	return len(h.hooks)
+}
+
+// after unwinds the first n hooks in reverse order.
+func (h *hookedCache) after(op *Operation, n int) {
+	for i := n - 1; i >= 0; i-- {
+		h.hooks[i].AfterOperation(op)
+	}
+}
+
+// Apply runs the write operation op through the hooks.
+func (h *hookedCache) Apply(op *Operation) error {
+	n := h.before(op)
+	if n == len(h.hooks) {
+		op.Err = apply(h.Cache, op)
+	}
+	h.after(op, n)
+	return op.Err
+}
+
+func (h *hookedCache) CacheByKey(key string, val interface{}, ex time.Duration) {
+	h.Apply(&Operation{Name: OpSet, Key: key, Value: val, TTL: ex})
+}
+
+func (h *hookedCache) CacheRawByKey(key string, val string, ex time.Duration) {
+	h.Apply(&Operation{Name: OpSetRaw, Key: key, Value: val, TTL: ex})
+}
+
+func (h *hookedCache) ReplaceRawByKey(key string, val string, ex time.Duration) (bool, error) {
+	op := &Operation{Name: OpReplaceRaw, Key: key, Value: val, TTL: ex}
+	n := h.before(op)
+	if n == len(h.hooks) {
+		if rc, ok := h.Cache.(RawCache); ok {
+			raw, _ := op.Value.(string)
+			var replaced bool
+			if replaced, op.Err = rc.ReplaceRawByKey(op.Key, raw, op.TTL); replaced {
+				op.Result = "OK"
+			}
+		} else {
+			op.Err = ErrNotRawCache
+		}
+	}
+	h.after(op, n)
+	return op.Result == "OK" && op.Err == nil, op.Err
+}
+
+func (h *hookedCache) GetByKey(key string) (string, error) {
+	op := &Operation{Name: OpGet, Key: key}
+	n := h.before(op)
+	if n == len(h.hooks) {
+		op.Result, op.Err = h.Cache.GetByKey(op.Key)
+	}
+	h.after(op, n)
+	return op.Result, op.Err
+}
+
+func (h *hookedCache) GetTTLByKey(key string) (time.Duration, error) {
+	op := &Operation{Name: OpGetTTL, Key: key}
+	n := h.before(op)
+	if n == len(h.hooks) {
+		if rc, ok := h.Cache.(RawCache); ok {
+			op.TTL, op.Err = rc.GetTTLByKey(op.Key)
+		} else {
+			op.Err = ErrNotRawCache
+		}
+	}
+	h.after(op, n)
+	return op.TTL, op.Err
+}
+
+func (h *hookedCache) GetKeysByPattern(key string, count int64) ([]string, error) {
+	op := &Operation{Name: OpScan, Key: key, Count: count}
+	n := h.before(op)
+	if n == len(h.hooks) {
+		op.Keys, op.Err = h.Cache.GetKeysByPattern(op.Key, op.Count)
+	}
+	h.after(op, n)
+	return op.Keys, op.Err
+}
+
+func (h *hookedCache) DeleteKey(key string) {
+	h.Apply(&Operation{Name: OpDelete, Key: key})
+}
+
+func (h *hookedCache) BatchDeletionKeysByPattern(key string, count int64) {
+	h.Apply(&Operation{Name: OpDeletePattern, Key: key, Count: count})
+}
+
+func (h *hookedCache) FlushDB() {
+	h.Apply(&Operation{Name: OpFlushDB})
+}
+
+func (h *hookedCache) FlushAll() {
+	h.Apply(&Operation{Name: OpFlushAll})
+}
+
+// ReplicationHook mirrors successful writes, deletes and flushes to a
+// secondary cache. Raw writes are only mirrored to a RawCache.
+func ReplicationHook(secondary Cache) Hook {
+	return HookFuncs{After: func(op *Operation) {
+		if op.Err != nil {
+			return
+		}
+		switch op.Name {
+		case OpSet:
+			secondary.CacheByKey(op.Key, op.Value, op.TTL)
+		case OpSetRaw:
+			raw, _ := op.Value.(string)
+			if rc, ok := secondary.(RawCache); ok {
+				rc.CacheRawByKey(op.Key, raw, op.TTL)
+			}
+		case OpReplaceRaw:
+			raw, _ := op.Value.(string)
+			if rc, ok := secondary.(RawCache); ok && op.Result == "OK" {
+				rc.ReplaceRawByKey(op.Key, raw, op.TTL)
+			}
+		case OpDelete:
+			secondary.DeleteKey(op.Key)
+		case OpDeletePattern:
+			secondary.BatchDeletionKeysByPattern(op.Key, op.Count)
+		case OpFlushDB:
+			secondary.FlushDB()
+		case OpFlushAll:
+			secondary.FlushAll()
+		}
+	}}
+}
@@ -0,0 +1,105 @@
+package cache_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ahmadIte99/hamdan_common/cache"
+	"github.com/ahmadIte99/hamdan_common/cache/cachetest"
+)
+
+// traceHook appends "<name>.before" and "<name>.after" to log and vetoes
+// every operation when veto is set.
+func traceHook(name string, log *[]string, veto error) cache.Hook {
+	return cache.HookFuncs{
+		Before: func(op *cache.Operation) error {
+			*log = append(*log, name+".before")
+			return veto
+		},
+		After: func(op *cache.Operation) {
+			*log = append(*log, name+".after")
+		},
+	}
+}
+
+func TestHookOrder(t *testing.T) {
+	var log []string
+	c := cache.NewHookedCache(cachetest.NewRecorder(),
+		traceHook("a", &log, nil), traceHook("b", &log, nil))
+
+	c.CacheByKey("k", 1, 0)
+
+	want := []string{"a.before", "b.before", "b.after", "a.after"}
+	if !reflect.DeepEqual(log, want) {
+		t.Fatalf("got %v, want %v", log, want)
+	}
+}
+
+func TestHookVetoUnwindsOnlyRunHooks(t *testing.T) {
+	veto := errors.New("veto")
+	var log []string
+	rec := cachetest.NewRecorder()
+	c := cache.NewHookedCache(rec,
+		traceHook("a", &log, nil), traceHook("b", &log, veto), traceHook("c", &log, nil))
+
+	if _, err := c.GetByKey("k"); err != veto {
+		t.Fatalf("got %v, want the veto", err)
+	}
+	want := []string{"a.before", "b.before", "a.after"}
+	if !reflect.DeepEqual(log, want) {
+		t.Fatalf("got %v, want %v", log, want)
+	}
+	rec.ExpectNoCalls(t)
+}
+
+func TestHookSeesWriteError(t *testing.T) {
+	fail := errors.New("write failed")
+	rec := cachetest.NewRecorder()
+	rec.SetError("k", fail)
+	var got error
+	c := cache.NewHookedCache(rec, cache.HookFuncs{After: func(op *cache.Operation) {
+		got = op.Err
+	}})
+
+	c.CacheByKey("k", 1, 0)
+	if got != fail {
+		t.Fatalf("set: got %v, want %v", got, fail)
+	}
+	c.DeleteKey("k")
+	if got != fail {
+		t.Fatalf("delete: got %v, want %v", got, fail)
+	}
+	c.CacheByKey("other", 1, 0)
+	if got != nil {
+		t.Fatalf("got %v, want nil", got)
+	}
+}
+
+func TestReplicationHook(t *testing.T) {
+	fail := errors.New("write failed")
+	primary := cachetest.NewRecorder()
+	primary.SetError("bad", fail)
+	secondary := cachetest.NewRecorder()
+	c := cache.NewHookedCache(primary, cache.ReplicationHook(secondary))
+
+	c.CacheByKey("good", "v", 0)
+	c.CacheByKey("bad", "v", 0)
+	c.(cache.RawCache).CacheRawByKey("raw", "v", 0)
+	c.DeleteKey("gone")
+
+	secondary.ExpectKeyValue(t, "good", "v")
+	secondary.ExpectKeyNotSet(t, "bad")
+	secondary.ExpectKeySet(t, "raw")
+	secondary.ExpectKeyDeleted(t, "gone")
+}
+
+func TestReplicationHookSkipsVetoedWrites(t *testing.T) {
+	secondary := cachetest.NewRecorder()
+	c := cache.NewHookedCache(cachetest.NewRecorder(),
+		cache.ReplicationHook(secondary),
+		cache.HookFuncs{Before: func(op *cache.Operation) error { return errors.New("veto") }})
+
+	c.CacheByKey("k", "v", 0)
+	secondary.ExpectNoCalls(t)
+}
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"github.com/go-redis/redis/v8"
+
+	"github.com/ahmadIte99/hamdan_common/logging"
 )
 
 type redisCache struct {
@@ -78,6 +80,42 @@ func (r *redisCache) GetByKey(key string) (string, error) {
 
 }
 
+// CacheRawByKey stores val as is, without JSON encoding it.
+func (r *redisCache) CacheRawByKey(key string, val string, ex time.Duration) {
+	if r.rdb == nil {
+		return
+	}
+	r.rdb.Set(r.ctx, key, val, ex).Err()
+}
+
+// ReplaceRawByKey stores val as is when key exists, see RawCache.
+func (r *redisCache) ReplaceRawByKey(key string, val string, ex time.Duration) (bool, error) {
+	if r.rdb == nil {
+		return false, errors.New("no redis client")
+	}
+	return r.rdb.SetXX(r.ctx, key, val, ex).Result()
+}
+
+// GetTTLByKey returns the remaining time to live of key, 0 when the key
+// has no expiration and redis.Nil when it does not exist.
+func (r *redisCache) GetTTLByKey(key string) (time.Duration, error) {
+	if r.rdb == nil {
+		return 0, errors.New("no redis client")
+	}
+
+	ttl, err := r.rdb.PTTL(r.ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	switch ttl {
+	case -2:
+		return 0, redis.Nil
+	case -1:
+		return 0, nil
+	}
+	return ttl, nil
+}
+
 //PASS
 func (r *redisCache) GetKeysByPattern(key string, count int64) ([]string, error) {
 
@@ -118,22 +156,31 @@ func (r *redisCache) BatchDeletionKeysByPattern(key string, count int64) {
 		return
 	}
 
+	if err := r.deleteByPattern(key, count); err != nil {
+		// panic(err)
+		logging.Error("cache batch delete failed", "pattern", key, "err", err)
+	}
+
+}
+
+func (r *redisCache) deleteByPattern(key string, count int64) error {
 	var cursor uint64
 	for {
 		var keys []string
 		var err error
 		keys, cursor, err = r.rdb.Scan(r.ctx, cursor, key, count).Result()
 		if err != nil {
-			// panic(err)
-			fmt.Println("batchdelete", err.Error())
-			break
+			return err
+		}
+		if len(keys) > 0 {
+			if err := r.rdb.Del(r.ctx, keys...).Err(); err != nil {
+				return err
+			}
 		}
-		r.rdb.Del(r.ctx, keys...)
 		if cursor == 0 {
-			break
+			return nil
 		}
 	}
-
 }
 
 //PASS
@@ -149,3 +196,30 @@ func (r *redisCache) FlushDB() {
 func (r *redisCache) FlushAll() {
 	r.rdb.FlushAll(r.ctx)
 }
+
+// Apply runs the write operation op and returns its error, see OperationApplier.
+func (r *redisCache) Apply(op *Operation) error {
+	if r.rdb == nil {
+		return errors.New("no redis client")
+	}
+	switch op.Name {
+	case OpSet:
+		j, err := json.Marshal(op.Value)
+		if err != nil {
+			return err
+		}
+		return r.rdb.Set(r.ctx, op.Key, j, op.TTL).Err()
+	case OpSetRaw:
+		raw, _ := op.Value.(string)
+		return r.rdb.Set(r.ctx, op.Key, raw, op.TTL).Err()
+	case OpDelete:
+		return r.rdb.Del(r.ctx, op.Key).Err()
+	case OpDeletePattern:
+		return r.deleteByPattern(op.Key, op.Count)
+	case OpFlushDB:
+		return r.rdb.FlushDB(r.ctx).Err()
+	case OpFlushAll:
+		return r.rdb.FlushAll(r.ctx).Err()
+	}
+	return fmt.Errorf("unsupported cache operation %q", op.Name)
+}
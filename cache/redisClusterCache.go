@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"github.com/go-redis/redis/v8"
+
+	"github.com/ahmadIte99/hamdan_common/logging"
 )
 
 type redisClusterCache struct {
@@ -84,6 +86,42 @@ func (r *redisClusterCache) GetByKey(key string) (string, error) {
 
 }
 
+// CacheRawByKey stores val as is, without JSON encoding it.
+func (r *redisClusterCache) CacheRawByKey(key string, val string, ex time.Duration) {
+	if r.rdb == nil {
+		return
+	}
+	r.rdb.Set(r.ctx, key, val, ex).Err()
+}
+
+// ReplaceRawByKey stores val as is when key exists, see RawCache.
+func (r *redisClusterCache) ReplaceRawByKey(key string, val string, ex time.Duration) (bool, error) {
+	if r.rdb == nil {
+		return false, errors.New("no redis client")
+	}
+	return r.rdb.SetXX(r.ctx, key, val, ex).Result()
+}
+
+// GetTTLByKey returns the remaining time to live of key, 0 when the key
+// has no expiration and redis.Nil when it does not exist.
+func (r *redisClusterCache) GetTTLByKey(key string) (time.Duration, error) {
+	if r.rdb == nil {
+		return 0, errors.New("no redis client")
+	}
+
+	ttl, err := r.rdb.PTTL(r.ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	switch ttl {
+	case -2:
+		return 0, redis.Nil
+	case -1:
+		return 0, nil
+	}
+	return ttl, nil
+}
+
 //PASS
 func (r *redisClusterCache) GetKeysByPattern(key string, count int64) ([]string, error) {
 
@@ -106,7 +144,7 @@ func (r *redisClusterCache) GetKeysByPattern(key string, count int64) ([]string,
 				keys, cursor, err = client.ScanType(ctx, cursor, key, count, "string").Result()
 
 				if err != nil {
-					fmt.Println("from callback", err.Error())
+					logging.Error("cache scan failed", "pattern", key, "err", err)
 					return err
 				}
 				queue <- keys
@@ -147,7 +185,14 @@ func (r *redisClusterCache) BatchDeletionKeysByPattern(key string, count int64)
 		return
 	}
 
-	r.rdb.ForEachMaster(r.ctx, func(ctx context.Context, client *redis.Client) error {
+	if err := r.deleteByPattern(key, count); err != nil {
+		logging.Error("cache batch delete failed", "pattern", key, "err", err)
+	}
+
+}
+
+func (r *redisClusterCache) deleteByPattern(key string, count int64) error {
+	return r.rdb.ForEachMaster(r.ctx, func(ctx context.Context, client *redis.Client) error {
 
 		var cursor uint64
 		for {
@@ -156,7 +201,6 @@ func (r *redisClusterCache) BatchDeletionKeysByPattern(key string, count int64)
 			keys, cursor, err = client.ScanType(ctx, cursor, key, count, "string").Result()
 
 			if err != nil {
-				fmt.Println("batchdelete", err.Error())
 				return err
 			}
 			pipe := client.Pipeline()
@@ -164,7 +208,9 @@ func (r *redisClusterCache) BatchDeletionKeysByPattern(key string, count int64)
 			for _, k := range keys {
 				pipe.Del(ctx, k)
 			}
-			pipe.Exec(ctx)
+			if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+				return err
+			}
 
 			if cursor == 0 {
 				break
@@ -174,7 +220,6 @@ func (r *redisClusterCache) BatchDeletionKeysByPattern(key string, count int64)
 		return nil
 
 	})
-
 }
 
 //PASS
@@ -224,3 +269,34 @@ func (r *redisClusterCache) FlushAll() {
 
 	})
 }
+
+// Apply runs the write operation op and returns its error, see OperationApplier.
+func (r *redisClusterCache) Apply(op *Operation) error {
+	if r.rdb == nil {
+		return errors.New("no redis client")
+	}
+	switch op.Name {
+	case OpSet:
+		j, err := json.Marshal(op.Value)
+		if err != nil {
+			return err
+		}
+		return r.rdb.Set(r.ctx, op.Key, j, op.TTL).Err()
+	case OpSetRaw:
+		raw, _ := op.Value.(string)
+		return r.rdb.Set(r.ctx, op.Key, raw, op.TTL).Err()
+	case OpDelete:
+		return r.rdb.Del(r.ctx, op.Key).Err()
+	case OpDeletePattern:
+		return r.deleteByPattern(op.Key, op.Count)
+	case OpFlushDB:
+		return r.rdb.ForEachMaster(r.ctx, func(ctx context.Context, client *redis.Client) error {
+			return client.FlushDB(ctx).Err()
+		})
+	case OpFlushAll:
+		return r.rdb.ForEachMaster(r.ctx, func(ctx context.Context, client *redis.Client) error {
+			return client.FlushAll(ctx).Err()
+		})
+	}
+	return fmt.Errorf("unsupported cache operation %q", op.Name)
+}
@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrNoSessionExpiry = errors.New("session: IdleTimeout or MaxLifetime must be positive")
+)
+
+// Session is a server side session stored in the cache.
+type Session struct {
+	Id     string `json:"id"`
+	UserId string `json:"userId"`
+	// Client, when set, binds the session to the x-client it was created for.
+	Client    string          `json:"client,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	LastSeen  time.Time       `json:"lastSeen"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+}
+
+// Decode unmarshals the session data into v.
+func (s *Session) Decode(v interface{}) error {
+	if len(s.Data) == 0 {
+		return errors.New("session has no data")
+	}
+	return json.Unmarshal(s.Data, v)
+}
+
+// SessionStore keeps sessions in a Cache keyed by an opaque id.
+// Every Get slides the expiration forward by IdleTimeout, up to MaxLifetime
+// after creation when it is set. With no IdleTimeout sessions last
+// MaxLifetime; a store with neither refuses to create sessions, since
+// they would never expire.
+//
+// A session id is a bearer credential: whoever presents it is the session
+// user. Use CreateForClient to also bind it to the client it was issued to.
+//
+// With a RawCache, Get only extends sessions that are still stored, so a
+// Get racing Delete or DeleteByUser can't bring a session back. Other
+// caches can't check and write atomically.
+type SessionStore struct {
+	Cache       Cache
+	Prefix      string
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	ScanCount   int64
+}
+
+func NewSessionStore(c Cache, idleTimeout time.Duration) *SessionStore {
+	return &SessionStore{
+		Cache:       c,
+		Prefix:      "session",
+		IdleTimeout: idleTimeout,
+		ScanCount:   100,
+	}
+}
+
+func (s *SessionStore) sessionKey(id string) string {
+	return s.Prefix + ":id:" + id
+}
+
+// userKey escapes userId so the keys of one user never match the
+// pattern of another, e.g. "u1" and "u1:x".
+func (s *SessionStore) userKey(userId string, id string) string {
+	return s.Prefix + ":user:" + url.QueryEscape(userId) + ":" + id
+}
+
+// ttl returns the expiration for a session seen at now.
+func (s *SessionStore) ttl(sess *Session, now time.Time) time.Duration {
+	var expires time.Time
+	if s.IdleTimeout > 0 {
+		expires = now.Add(s.IdleTimeout)
+	} else {
+		expires = sess.CreatedAt.Add(s.MaxLifetime)
+	}
+	if s.MaxLifetime > 0 {
+		if max := sess.CreatedAt.Add(s.MaxLifetime); max.Before(expires) {
+			expires = max
+		}
+	}
+	sess.ExpiresAt = expires
+	return expires.Sub(now)
+}
+
+// save stores sess, reporting false when it has already expired.
+func (s *SessionStore) save(sess *Session, now time.Time) bool {
+	ttl := s.ttl(sess, now)
+	if ttl <= 0 {
+		// a zero ttl would store the session without expiry
+		return false
+	}
+	s.Cache.CacheByKey(s.sessionKey(sess.Id), sess, ttl)
+	s.Cache.CacheByKey(s.userKey(sess.UserId, sess.Id), sess.Id, ttl)
+	return true
+}
+
+// touch writes back a session read by Get with its new expiration. With a
+// RawCache it reports false, without writing, when the session is gone.
+func (s *SessionStore) touch(sess *Session, now time.Time) (bool, error) {
+	rc, ok := s.Cache.(RawCache)
+	if !ok {
+		return s.save(sess, now), nil
+	}
+	ttl := s.ttl(sess, now)
+	if ttl <= 0 {
+		return false, nil
+	}
+	j, err := json.Marshal(sess)
+	if err != nil {
+		return false, err
+	}
+	if replaced, err := rc.ReplaceRawByKey(s.sessionKey(sess.Id), string(j), ttl); err != nil || !replaced {
+		return false, err
+	}
+	id, _ := json.Marshal(sess.Id)
+	if _, err := rc.ReplaceRawByKey(s.userKey(sess.UserId, sess.Id), string(id), ttl); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Create stores a new session for userId holding data and returns it.
+func (s *SessionStore) Create(userId string, data interface{}) (*Session, error) {
+	return s.CreateForClient(userId, "", data)
+}
+
+// CreateForClient is Create for a session only valid with the x-client
+// client, see Session.Client.
+func (s *SessionStore) CreateForClient(userId string, client string, data interface{}) (*Session, error) {
+	if userId == "" {
+		return nil, errors.New("session: empty user id")
+	}
+	if s.IdleTimeout <= 0 && s.MaxLifetime <= 0 {
+		return nil, ErrNoSessionExpiry
+	}
+	id, err := newSessionId()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sess := &Session{Id: id, UserId: userId, Client: client, CreatedAt: now, LastSeen: now}
+	if data != nil {
+		j, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		sess.Data = j
+	}
+	if !s.save(sess, now) {
+		return nil, ErrNoSessionExpiry
+	}
+	return sess, nil
+}
+
+// Get returns the session with id and extends its expiration.
+func (s *SessionStore) Get(id string) (*Session, error) {
+	sess, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sess.LastSeen = now
+	ok, err := s.touch(sess, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		s.remove(sess)
+		return nil, ErrSessionNotFound
+	}
+	return sess, nil
+}
+
+func (s *SessionStore) load(id string) (*Session, error) {
+	if id == "" {
+		return nil, ErrSessionNotFound
+	}
+	val, err := s.Cache.GetByKey(s.sessionKey(id))
+	if err == redis.Nil {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sess Session
+	if err := json.Unmarshal([]byte(val), &sess); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (s *SessionStore) remove(sess *Session) {
+	s.Cache.DeleteKey(s.sessionKey(sess.Id))
+	s.Cache.DeleteKey(s.userKey(sess.UserId, sess.Id))
+}
+
+// Delete removes the session with id.
+func (s *SessionStore) Delete(id string) error {
+	sess, err := s.load(id)
+	if err == ErrSessionNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.remove(sess)
+	return nil
+}
+
+// ListByUser returns the live sessions of userId.
+func (s *SessionStore) ListByUser(userId string) ([]*Session, error) {
+	prefix := s.userKey(userId, "")
+	keys, err := s.Cache.GetKeysByPattern(escapePattern(prefix)+"*", s.ScanCount)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []*Session{}
+	for _, k := range keys {
+		id := strings.TrimPrefix(k, prefix)
+		sess, err := s.load(id)
+		if err == ErrSessionNotFound {
+			s.Cache.DeleteKey(k)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, nil
+}
+
+// DeleteByUser removes every session of userId, logging the user out everywhere.
+func (s *SessionStore) DeleteByUser(userId string) error {
+	sessions, err := s.ListByUser(userId)
+	if err != nil {
+		return err
+	}
+	for _, sess := range sessions {
+		s.remove(sess)
+	}
+	return nil
+}
+
+func newSessionId() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// escapePattern escapes the glob characters understood by SCAN MATCH.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
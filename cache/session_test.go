@@ -0,0 +1,104 @@
+package cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/cache"
+	"github.com/ahmadIte99/hamdan_common/cache/cachetest"
+)
+
+func TestSessionStoreNeedsExpiry(t *testing.T) {
+	s := cache.NewSessionStore(cachetest.NewRecorder(), 0)
+	if _, err := s.Create("u1", nil); err != cache.ErrNoSessionExpiry {
+		t.Fatalf("Create without expiry: %v, want ErrNoSessionExpiry", err)
+	}
+}
+
+func TestSessionStoreMaxLifetimeOnly(t *testing.T) {
+	rec := cachetest.NewRecorder()
+	s := cache.NewSessionStore(rec, 0)
+	s.MaxLifetime = time.Hour
+	sess, err := s.Create("u1", map[string]string{"a": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := rec.ExpectKeySet(t, "session:id:"+sess.Id)
+	if c.TTL <= 0 || c.TTL > time.Hour {
+		t.Fatalf("session ttl = %s, want within MaxLifetime", c.TTL)
+	}
+}
+
+func TestSessionStoreGetSlides(t *testing.T) {
+	rec := cachetest.NewRecorder()
+	s := cache.NewSessionStore(rec, time.Minute)
+	sess, err := s.CreateForClient("u1", "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(sess.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserId != "u1" || got.Client != "web" {
+		t.Fatalf("Get = %+v", got)
+	}
+	rec.ExpectCalled(t, cachetest.MethodCacheByKey, 2)
+	rec.ExpectCalled(t, cachetest.MethodReplaceRawByKey, 2)
+
+	list, err := s.ListByUser("u1")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("ListByUser = %v, %v", list, err)
+	}
+	if err := s.DeleteByUser("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(sess.Id); err != cache.ErrSessionNotFound {
+		t.Fatalf("Get after DeleteByUser: %v", err)
+	}
+}
+
+func TestSessionStoreGetRacingDelete(t *testing.T) {
+	rec := cachetest.NewRecorder()
+	// the session is deleted between the read and the write back of Get
+	hooked := cache.NewHookedCache(rec, cache.HookFuncs{Before: func(op *cache.Operation) error {
+		if op.Name == cache.OpReplaceRaw {
+			rec.DeleteKey(op.Key)
+		}
+		return nil
+	}})
+	s := cache.NewSessionStore(hooked, time.Minute)
+	sess, err := s.Create("u1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(sess.Id); err != cache.ErrSessionNotFound {
+		t.Fatalf("Get = %v, want ErrSessionNotFound", err)
+	}
+	if keys := rec.Keys(); len(keys) != 0 {
+		t.Fatalf("session written back: %v", keys)
+	}
+}
+
+func TestSessionStoreUserIdsDontOverlap(t *testing.T) {
+	s := cache.NewSessionStore(cachetest.NewRecorder(), time.Minute)
+	if _, err := s.Create("u1", nil); err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Create("u1:x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.ListByUser("u1")
+	if err != nil || len(list) != 1 || list[0].UserId != "u1" {
+		t.Fatalf("ListByUser(u1) = %v, %v", list, err)
+	}
+	if err := s.DeleteByUser("u1"); err != nil {
+		t.Fatal(err)
+	}
+	list, err = s.ListByUser("u1:x")
+	if err != nil || len(list) != 1 || list[0].Id != other.Id {
+		t.Fatalf("ListByUser(u1:x) = %v, %v", list, err)
+	}
+}
@@ -0,0 +1,87 @@
+// Command cachedump exports cache keys to a JSON lines file and restores them.
+//
+//	cachedump dump -uri localhost:6379 -pattern 'users:*' -file users.jsonl
+//	cachedump restore -uri localhost:7000 -cluster -file users.jsonl
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ahmadIte99/hamdan_common/cache"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	mode := os.Args[1]
+	if mode != "dump" && mode != "restore" {
+		usage()
+	}
+
+	fs := flag.NewFlagSet(mode, flag.ExitOnError)
+	uri := fs.String("uri", "localhost:6379", "redis address")
+	password := fs.String("password", "", "redis password")
+	db := fs.Int("db", 0, "redis database")
+	cluster := fs.Bool("cluster", false, "connect to a redis cluster")
+	pattern := fs.String("pattern", "*", "key pattern to dump")
+	count := fs.Int64("count", 1000, "scan batch size")
+	file := fs.String("file", "-", "dump file, - for stdin/stdout")
+	fs.Parse(os.Args[2:])
+
+	var c cache.Cache
+	if *cluster {
+		c = cache.NewRedisClusterCache()
+	} else {
+		c = cache.NewRedisCache()
+	}
+	if err := c.Connect(*uri, *password, *db); err != nil {
+		fail(err)
+	}
+
+	switch mode {
+	case "dump":
+		var w io.Writer = os.Stdout
+		if *file != "-" {
+			f, err := os.Create(*file)
+			if err != nil {
+				fail(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		n, err := cache.Dump(c, *pattern, *count, w)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Fprintf(os.Stderr, "dumped %d keys\n", n)
+	case "restore":
+		var r io.Reader = os.Stdin
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				fail(err)
+			}
+			defer f.Close()
+			r = f
+		}
+		n, err := cache.Restore(c, r)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Fprintf(os.Stderr, "restored %d keys\n", n)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: cachedump dump|restore [flags]")
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "cachedump:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,248 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// Authorization middlewares check the user stored by GuardMiddleware and
+// answer 401 when there is none and 403 when a rule isn't met.
+//
+// Rules are tenant aware: a user has a role or capability when it is granted
+// globally, e.g. "admin", or for the tenant of the request, e.g. "acme:admin"
+// when the request is for the x-client acme. A tenant verified by
+// GuardMiddleware, see TenantFromContext, takes precedence over x-client.
+
+// RequireRoles requires every one of roles.
+func RequireRoles(roles ...string) Middleware {
+	return requireUser(func(u User, tenant string) bool {
+		return hasAll(u.Roles, tenant, roles)
+	})
+}
+
+// RequireAnyCapability requires at least one of capabilities.
+func RequireAnyCapability(capabilities ...string) Middleware {
+	return requireUser(func(u User, tenant string) bool {
+		for _, c := range capabilities {
+			if hasGrant(u.Capabilities, tenant, c) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RequireAllCapabilities requires every one of capabilities.
+func RequireAllCapabilities(capabilities ...string) Middleware {
+	return requireUser(func(u User, tenant string) bool {
+		return hasAll(u.Capabilities, tenant, capabilities)
+	})
+}
+
+// RequirePolicy requires the policy expression expr, see ParsePolicy.
+// It panics when expr is malformed.
+func RequirePolicy(expr string) Middleware {
+	p, err := ParsePolicy(expr)
+	if err != nil {
+		panic(err)
+	}
+	return requireUser(p.Allows)
+}
+
+func requireUser(allowed func(u User, tenant string) bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := UserFromContext(r.Context())
+			if !ok {
+				writeGuardError(w, r, newGuardError(ErrUnauthenticated, nil))
+				return
+			}
+			if !allowed(user, requestTenant(r)) {
+				writeGuardError(w, r, newGuardError(ErrForbidden, nil))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestTenant returns the tenant verified by GuardMiddleware, or the
+// client of r.
+func requestTenant(r *http.Request) string {
+	if tenant, ok := TenantFromContext(r.Context()); ok {
+		return tenant
+	}
+	if h, ok := HeaderParamsFromContext(r.Context()); ok {
+		return h.Client
+	}
+	return ExtractHeaderParams(r).Client
+}
+
+// hasGrant reports whether grants hold name globally or for tenant.
+func hasGrant(grants []string, tenant string, name string) bool {
+	return hasString(grants, name) || (tenant != "" && hasString(grants, tenant+":"+name))
+}
+
+func hasAll(grants []string, tenant string, names []string) bool {
+	for _, name := range names {
+		if !hasGrant(grants, tenant, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Policy is a parsed policy expression.
+type Policy struct {
+	expr string
+	eval func(u User, tenant string) bool
+}
+
+// ParsePolicy parses a policy expression made of the terms
+//
+//	role:<name>        the user has the role
+//	cap:<name>         the user has the capability
+//	tenant:<id>        the request is for the tenant
+//
+// combined with !, && and || and grouped with parentheses, e.g.
+// "role:admin || (cap:posts.write && !tenant:demo)". && binds tighter than ||.
+func ParsePolicy(expr string) (*Policy, error) {
+	p := &policyParser{tokens: tokenizePolicy(expr)}
+	eval, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("policy %q: %v", expr, err)
+	}
+	return &Policy{expr: expr, eval: eval}, nil
+}
+
+// Allows reports whether the policy allows user on a request for tenant.
+func (p *Policy) Allows(user User, tenant string) bool {
+	return p.eval(user, tenant)
+}
+
+func (p *Policy) String() string {
+	return p.expr
+}
+
+func tokenizePolicy(expr string) []string {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		default:
+			j := strings.IndexFunc(expr[i:], func(r rune) bool {
+				return unicode.IsSpace(r) || strings.ContainsRune("()!&|", r)
+			})
+			if j < 0 {
+				j = len(expr) - i
+			}
+			if j == 0 {
+				// a lone & or |
+				j = 1
+			}
+			tokens = append(tokens, expr[i:i+j])
+			i += j
+		}
+	}
+	return tokens
+}
+
+type policyFunc func(u User, tenant string) bool
+
+type policyParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *policyParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *policyParser) or() (policyFunc, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.next() == "||" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(u User, tenant string) bool { return l(u, tenant) || right(u, tenant) }
+	}
+	return left, nil
+}
+
+func (p *policyParser) and() (policyFunc, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.next() == "&&" {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(u User, tenant string) bool { return l(u, tenant) && right(u, tenant) }
+	}
+	return left, nil
+}
+
+func (p *policyParser) unary() (policyFunc, error) {
+	tok := p.next()
+	p.pos++
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	case "!":
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(u User, tenant string) bool { return !f(u, tenant) }, nil
+	case "(":
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return f, nil
+	}
+
+	i := strings.Index(tok, ":")
+	if i <= 0 || i == len(tok)-1 {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	kind, name := tok[:i], tok[i+1:]
+	switch kind {
+	case "role":
+		return func(u User, tenant string) bool { return hasGrant(u.Roles, tenant, name) }, nil
+	case "cap":
+		return func(u User, tenant string) bool { return hasGrant(u.Capabilities, tenant, name) }, nil
+	case "tenant":
+		return func(u User, tenant string) bool { return tenant == name }, nil
+	}
+	return nil, fmt.Errorf("unknown term %q", tok)
+}
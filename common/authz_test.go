@@ -0,0 +1,100 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	admin := User{Roles: []string{"admin"}}
+	writer := User{Capabilities: []string{"posts.write"}}
+	acmeWriter := User{Capabilities: []string{"acme:posts.write"}}
+
+	for _, tc := range []struct {
+		expr   string
+		user   User
+		tenant string
+		want   bool
+	}{
+		{"role:admin", admin, "", true},
+		{"role:admin", writer, "", false},
+		{"cap:posts.write", writer, "acme", true},
+		{"cap:posts.write", acmeWriter, "acme", true},
+		{"cap:posts.write", acmeWriter, "other", false},
+		{"cap:posts.write", acmeWriter, "", false},
+		{"tenant:acme", User{}, "acme", true},
+		{"!tenant:acme", User{}, "acme", false},
+		{"role:admin || cap:posts.write && tenant:demo", writer, "acme", false},
+		{"role:admin || cap:posts.write && tenant:demo", admin, "acme", true},
+		{"(role:admin || cap:posts.write) && !tenant:demo", writer, "acme", true},
+		{"(role:admin || cap:posts.write) && !tenant:demo", writer, "demo", false},
+		{"!!role:admin", admin, "", true},
+		{"role:admin&&cap:posts.write", User{Roles: []string{"admin"}, Capabilities: []string{"posts.write"}}, "", true},
+	} {
+		p, err := ParsePolicy(tc.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tc.expr, err)
+			continue
+		}
+		if got := p.Allows(tc.user, tc.tenant); got != tc.want {
+			t.Errorf("%q for %+v on %q: got %v, want %v", tc.expr, tc.user, tc.tenant, got, tc.want)
+		}
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"role:",
+		":admin",
+		"admin",
+		"group:admins",
+		"role:admin &&",
+		"role:admin & cap:x",
+		"(role:admin",
+		"role:admin)",
+		"role:admin cap:x",
+		"!",
+	} {
+		if _, err := ParsePolicy(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestRequireRolesTenant(t *testing.T) {
+	handler := RequireRoles("admin")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	user := User{Id: "u1", Roles: []string{"acme:admin"}}
+
+	for _, tc := range []struct {
+		name   string
+		ctx    func(ctx context.Context) context.Context
+		header map[string]string
+		want   int
+	}{
+		{"no user", func(ctx context.Context) context.Context { return ctx }, nil, http.StatusUnauthorized},
+		{"client", withUserFunc(user), map[string]string{"x-client": "acme"}, http.StatusOK},
+		{"other client", withUserFunc(user), map[string]string{"x-client": "other"}, http.StatusForbidden},
+		{"tenant header ignored", withUserFunc(user), map[string]string{"x-tenant-id": "acme"}, http.StatusForbidden},
+		{"verified tenant", func(ctx context.Context) context.Context {
+			return WithTenant(WithUser(ctx, user), "acme")
+		}, map[string]string{"x-client": "other"}, http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		for k, v := range tc.header {
+			r.Header.Set(k, v)
+		}
+		r = r.WithContext(tc.ctx(r.Context()))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
+
+func withUserFunc(user User) func(ctx context.Context) context.Context {
+	return func(ctx context.Context) context.Context { return WithUser(ctx, user) }
+}
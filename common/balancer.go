@@ -0,0 +1,140 @@
+package common
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy selects how an instance of a service is picked.
+type Strategy string
+
+const (
+	RoundRobin    Strategy = "roundRobin"
+	LeastInFlight Strategy = "leastInFlight"
+)
+
+// FailureCooldown is how long an instance that failed is skipped
+// while other healthy instances are available.
+var FailureCooldown = 10 * time.Second
+
+// Instance is one base url of a service picked by the registry.
+// Done must be called once the call is over.
+type Instance struct {
+	inFlight int64 // first for 64-bit atomic alignment
+
+	URL string
+
+	mu          sync.Mutex
+	failedUntil time.Time
+}
+
+func (i *Instance) healthy(now time.Time) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return !now.Before(i.failedUntil)
+}
+
+func (i *Instance) release() {
+	atomic.AddInt64(&i.inFlight, -1)
+}
+
+// Done releases the instance and passively marks it unhealthy for
+// FailureCooldown when failed is true.
+func (i *Instance) Done(failed bool) {
+	i.release()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if failed {
+		i.failedUntil = time.Now().Add(FailureCooldown)
+	} else {
+		i.failedUntil = time.Time{}
+	}
+}
+
+// InFlight returns the number of calls currently using the instance.
+func (i *Instance) InFlight() int64 {
+	return atomic.LoadInt64(&i.inFlight)
+}
+
+type balancer struct {
+	urls      string
+	instances []*Instance
+	strategy  Strategy
+	next      uint64
+}
+
+func newBalancer(urls []string, strategy Strategy) *balancer {
+	b := &balancer{urls: strings.Join(urls, ","), strategy: strategy}
+	for _, u := range urls {
+		b.instances = append(b.instances, &Instance{URL: u})
+	}
+	return b
+}
+
+// pick returns an instance not in exclude, preferring healthy ones.
+// It returns nil when every instance is excluded.
+func (b *balancer) pick(exclude map[*Instance]bool) *Instance {
+	now := time.Now()
+	var candidates, unhealthy []*Instance
+	for _, i := range b.instances {
+		if exclude[i] {
+			continue
+		}
+		if i.healthy(now) {
+			candidates = append(candidates, i)
+		} else {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = unhealthy
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var picked *Instance
+	switch b.strategy {
+	case LeastInFlight:
+		start := int(atomic.AddUint64(&b.next, 1) % uint64(len(candidates)))
+		for n := 0; n < len(candidates); n++ {
+			i := candidates[(start+n)%len(candidates)]
+			if picked == nil || i.InFlight() < picked.InFlight() {
+				picked = i
+			}
+		}
+	default:
+		picked = candidates[(atomic.AddUint64(&b.next, 1)-1)%uint64(len(candidates))]
+	}
+	atomic.AddInt64(&picked.inFlight, 1)
+	return picked
+}
+
+// splitURLs splits a comma separated list of urls.
+func splitURLs(s string) []string {
+	var urls []string
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// isIdempotent reports whether a request with method can safely be sent again.
+func isIdempotent(method string) bool {
+	switch strings.ToUpper(method) {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// instanceFailed reports whether a response status means the instance,
+// not the request, is at fault.
+func instanceFailed(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
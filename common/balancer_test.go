@@ -0,0 +1,156 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoundRobin(t *testing.T) {
+	b := newBalancer([]string{"a", "b", "c"}, RoundRobin)
+	var got []string
+	for n := 0; n < 6; n++ {
+		i := b.pick(nil)
+		got = append(got, i.URL)
+		i.Done(false)
+	}
+	want := "a b c a b c"
+	if s := strings.Join(got, " "); s != want {
+		t.Fatalf("got %s, want %s", s, want)
+	}
+}
+
+func TestLeastInFlight(t *testing.T) {
+	b := newBalancer([]string{"a", "b", "c"}, LeastInFlight)
+	first := b.pick(nil)
+	second := b.pick(nil)
+	third := b.pick(nil)
+	if first == second || second == third || first == third {
+		t.Fatalf("busy instances picked again: %s %s %s", first.URL, second.URL, third.URL)
+	}
+	second.Done(false)
+	if i := b.pick(nil); i != second {
+		t.Fatalf("got %s, want the idle %s", i.URL, second.URL)
+	}
+	if second.InFlight() != 1 || first.InFlight() != 1 {
+		t.Fatalf("in flight: %d, %d", first.InFlight(), second.InFlight())
+	}
+}
+
+func TestFailureCooldown(t *testing.T) {
+	defer func(d time.Duration) { FailureCooldown = d }(FailureCooldown)
+	FailureCooldown = 30 * time.Millisecond
+
+	b := newBalancer([]string{"a", "b"}, RoundRobin)
+	b.pick(nil).Done(true)
+	for n := 0; n < 4; n++ {
+		i := b.pick(nil)
+		if i.URL != "b" {
+			t.Fatalf("pick %d: got %s during the cooldown", n, i.URL)
+		}
+		i.Done(false)
+	}
+	if i := b.pick(map[*Instance]bool{b.instances[1]: true}); i == nil || i.URL != "a" {
+		t.Fatalf("got %v, want the failed instance when it is the only one left", i)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	seen := map[string]bool{}
+	for n := 0; n < 2; n++ {
+		i := b.pick(nil)
+		seen[i.URL] = true
+		i.Done(false)
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Fatalf("got %v after the cooldown", seen)
+	}
+	if i := b.pick(map[*Instance]bool{b.instances[0]: true, b.instances[1]: true}); i != nil {
+		t.Fatalf("got %s with every instance excluded", i.URL)
+	}
+}
+
+// instanceServer answers with status and counts its requests.
+type instanceServer struct {
+	mu     sync.Mutex
+	status int
+	calls  int
+}
+
+func (s *instanceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	w.WriteHeader(s.status)
+}
+
+func (s *instanceServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func TestSendFailover(t *testing.T) {
+	down := httptest.NewServer(nil)
+	down.Close()
+
+	tests := []struct {
+		name   string
+		status int // of the first instance, 0 when it is unreachable
+		method string
+		key    string
+		want   int
+		// calls to the second instance
+		failover int
+	}{
+		{"GET fails over on 503", 503, "GET", "", 200, 1},
+		{"GET fails over on 502", 502, "GET", "", 200, 1},
+		{"GET fails over on a connection error", 0, "GET", "", 200, 1},
+		{"GET doesn't fail over on 500", 500, "GET", "", 500, 0},
+		{"PUT fails over", 504, "PUT", "", 200, 1},
+		{"POST isn't resent", 503, "POST", "", 503, 0},
+		{"POST with an idempotency key fails over", 503, "POST", "k", 200, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := &instanceServer{status: tt.status}
+			second := &instanceServer{status: 200}
+			firstURL := down.URL
+			if tt.status != 0 {
+				srv := httptest.NewServer(first)
+				defer srv.Close()
+				firstURL = srv.URL
+			}
+			srv := httptest.NewServer(second)
+			defer srv.Close()
+
+			registry := NewServiceRegistry()
+			registry.Register("orders", firstURL+","+srv.URL)
+			c := NewServiceClient(registry)
+
+			resp, err := c.Do(context.Background(), &RequestParams{
+				Service: "orders", Path: "x", Method: tt.method, IdempotencyKey: tt.key,
+				Data: map[string]interface{}{"n": 1},
+			})
+			if tt.status == 0 && tt.failover == 0 {
+				if err == nil {
+					t.Fatal("expected a connection error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want || second.count() != tt.failover {
+				t.Fatalf("got %d with %d calls to the second instance, want %d with %d", resp.StatusCode, second.count(), tt.want, tt.failover)
+			}
+			if tt.status != 0 && first.count() != 1 {
+				t.Fatalf("first instance called %d times", first.count())
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a service circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitOpenError is returned without calling a service whose breaker is open.
+type CircuitOpenError struct {
+	Service string
+	Until   time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s: %v until %s", e.Service, ErrCircuitOpen, e.Until.Format(time.RFC3339))
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// BreakerSettings configures a circuit breaker. After FailureThreshold
+// consecutive failed calls the breaker opens and calls fail fast for
+// CoolDown, then up to HalfOpenCalls trial calls decide whether it closes
+// again or reopens.
+type BreakerSettings struct {
+	FailureThreshold int
+	CoolDown         time.Duration
+	HalfOpenCalls    int
+	// OnStateChange is called after every state change, outside the breaker lock.
+	OnStateChange func(service string, from BreakerState, to BreakerState)
+}
+
+// DefaultBreakerSettings opens after 5 consecutive failures for 30 seconds.
+var DefaultBreakerSettings = &BreakerSettings{
+	FailureThreshold: 5,
+	CoolDown:         30 * time.Second,
+	HalfOpenCalls:    1,
+}
+
+type circuitBreaker struct {
+	service  string
+	settings *BreakerSettings
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trials   int
+}
+
+func newCircuitBreaker(service string, settings *BreakerSettings) *circuitBreaker {
+	return &circuitBreaker{service: service, settings: settings}
+}
+
+// allow reports whether a call may go through, or the error to return.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	from := b.state
+	if b.state == BreakerOpen {
+		until := b.openedAt.Add(b.settings.CoolDown)
+		if time.Now().Before(until) {
+			b.mu.Unlock()
+			return &CircuitOpenError{Service: b.service, Until: until}
+		}
+		b.state = BreakerHalfOpen
+		b.trials = 0
+	}
+	if b.state == BreakerHalfOpen {
+		max := b.settings.HalfOpenCalls
+		if max < 1 {
+			max = 1
+		}
+		if b.trials >= max {
+			b.mu.Unlock()
+			return &CircuitOpenError{Service: b.service, Until: time.Now()}
+		}
+		b.trials++
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.changed(from, to)
+	return nil
+}
+
+// record reports the outcome of an allowed call.
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	from := b.state
+	switch {
+	case !failed:
+		b.failures = 0
+		b.state = BreakerClosed
+	case b.state == BreakerHalfOpen:
+		b.open()
+	default:
+		b.failures++
+		if b.settings.FailureThreshold > 0 && b.failures >= b.settings.FailureThreshold {
+			b.open()
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.changed(from, to)
+}
+
+// release gives back an allowed call whose outcome doesn't count, so a
+// half-open breaker can try another call.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen && b.trials > 0 {
+		b.trials--
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.failures = 0
+	b.trials = 0
+}
+
+func (b *circuitBreaker) changed(from BreakerState, to BreakerState) {
+	if from != to && b.settings.OnStateChange != nil {
+		b.settings.OnStateChange(b.service, from, to)
+	}
+}
+
+// SetServiceBreaker enables a circuit breaker for a service, nil disables it.
+func (c *ServiceClient) SetServiceBreaker(service string, settings *BreakerSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.breakerSettings[service] = settings
+	delete(c.breakers, service)
+}
+
+// BreakerState returns the breaker state of a service, closed when it has none.
+func (c *ServiceClient) BreakerState(service string) BreakerState {
+	b := c.breaker(service)
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (c *ServiceClient) breaker(service string) *circuitBreaker {
+	c.mu.RLock()
+	b, ok := c.breakers[service]
+	c.mu.RUnlock()
+	if ok {
+		return b
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.breakers[service]; ok {
+		return b
+	}
+	settings, ok := c.breakerSettings[service]
+	if !ok {
+		settings = c.Breaker
+	}
+	if settings != nil {
+		b = newCircuitBreaker(service, settings)
+	}
+	c.breakers[service] = b
+	return b
+}
@@ -0,0 +1,218 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// breakerService answers every call with the status in *status.
+func breakerService(t *testing.T, status *int) *ServiceClient {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(*status)
+	}))
+	t.Cleanup(srv.Close)
+
+	registry := NewServiceRegistry()
+	registry.Register("orders", srv.URL)
+	return NewServiceClient(registry)
+}
+
+func callOrders(c *ServiceClient) error {
+	resp, err := c.Do(context.Background(), &RequestParams{Service: "orders", Path: "x", Method: "GET"})
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestBreakerStates(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		// wait after the calls, past the cool down when true
+		coolDown bool
+		want     BreakerState
+	}{
+		{"closed below the threshold", []int{500, 500}, false, BreakerClosed},
+		{"success resets the count", []int{500, 500, 200, 500, 500}, false, BreakerClosed},
+		{"client errors don't count", []int{404, 404, 404, 404}, false, BreakerClosed},
+		{"open at the threshold", []int{500, 503, 500}, false, BreakerOpen},
+		{"closes after a trial past the cool down", []int{500, 500, 500}, true, BreakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := 200
+			c := breakerService(t, &status)
+			c.SetServiceBreaker("orders", &BreakerSettings{FailureThreshold: 3, CoolDown: 20 * time.Millisecond, HalfOpenCalls: 1})
+
+			for _, s := range tt.statuses {
+				status = s
+				if err := callOrders(c); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := c.BreakerState("orders"); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			if tt.want == BreakerOpen {
+				err := callOrders(c)
+				var open *CircuitOpenError
+				if !errors.As(err, &open) || !errors.Is(err, ErrCircuitOpen) || open.Service != "orders" {
+					t.Fatalf("got %v, want a *CircuitOpenError", err)
+				}
+			}
+			if tt.coolDown {
+				time.Sleep(30 * time.Millisecond)
+				status = 200
+				if err := callOrders(c); err != nil {
+					t.Fatal(err)
+				}
+				if got := c.BreakerState("orders"); got != BreakerClosed {
+					t.Fatalf("after the trial: got %v, want closed", got)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerHalfOpenTrialLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 4)
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		started <- struct{}{}
+		<-release
+	}))
+	defer srv.Close()
+	registry := NewServiceRegistry()
+	registry.Register("orders", srv.URL)
+	c := NewServiceClient(registry)
+	c.SetServiceBreaker("orders", &BreakerSettings{FailureThreshold: 1, CoolDown: 10 * time.Millisecond, HalfOpenCalls: 2})
+
+	callOrders(c)
+	if got := c.BreakerState("orders"); got != BreakerOpen {
+		t.Fatalf("got %v, want open", got)
+	}
+	time.Sleep(20 * time.Millisecond)
+	fail = false
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := callOrders(c); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	<-started
+	<-started
+	if got := c.BreakerState("orders"); got != BreakerHalfOpen {
+		t.Fatalf("got %v, want half-open", got)
+	}
+	if err := callOrders(c); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("third trial: got %v, want ErrCircuitOpen", err)
+	}
+	close(release)
+	wg.Wait()
+	if got := c.BreakerState("orders"); got != BreakerClosed {
+		t.Fatalf("got %v, want closed", got)
+	}
+}
+
+func TestBreakerHalfOpenFailureReopens(t *testing.T) {
+	status := 500
+	c := breakerService(t, &status)
+	c.SetServiceBreaker("orders", &BreakerSettings{FailureThreshold: 1, CoolDown: 10 * time.Millisecond})
+
+	callOrders(c)
+	time.Sleep(20 * time.Millisecond)
+	callOrders(c)
+	if got := c.BreakerState("orders"); got != BreakerOpen {
+		t.Fatalf("got %v, want open", got)
+	}
+}
+
+func TestBreakerOnStateChange(t *testing.T) {
+	type change struct {
+		from, to BreakerState
+	}
+	var changes []change
+	status := 500
+	c := breakerService(t, &status)
+	c.SetServiceBreaker("orders", &BreakerSettings{
+		FailureThreshold: 2,
+		CoolDown:         10 * time.Millisecond,
+		OnStateChange: func(service string, from BreakerState, to BreakerState) {
+			if service != "orders" {
+				t.Errorf("service: got %q", service)
+			}
+			changes = append(changes, change{from, to})
+		},
+	})
+
+	callOrders(c)
+	callOrders(c)
+	time.Sleep(20 * time.Millisecond)
+	status = 200
+	callOrders(c)
+
+	want := []change{{BreakerClosed, BreakerOpen}, {BreakerOpen, BreakerHalfOpen}, {BreakerHalfOpen, BreakerClosed}}
+	if len(changes) != len(want) {
+		t.Fatalf("got %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("got %v, want %v", changes, want)
+		}
+	}
+}
+
+func TestBreakerIgnoresCallerAndRegistryErrors(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	registry := NewServiceRegistry()
+	registry.Register("orders", srv.URL)
+	registry.RegisterService(Service{Name: "empty"})
+	c := NewServiceClient(registry)
+	c.Breaker = &BreakerSettings{FailureThreshold: 1, CoolDown: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := c.Do(ctx, &RequestParams{Service: "orders", Path: "x", Method: "GET"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if got := c.BreakerState("orders"); got != BreakerClosed {
+		t.Errorf("cancelled: got %v, want closed", got)
+	}
+
+	for _, service := range []string{"missing", "empty"} {
+		_, err := c.Do(context.Background(), &RequestParams{Service: service, Path: "x", Method: "GET"})
+		if err == nil {
+			t.Fatalf("%s: expected an error", service)
+		}
+		if got := c.BreakerState(service); got != BreakerClosed {
+			t.Errorf("%s: got %v, want closed", service, got)
+		}
+	}
+	if _, err := c.Do(context.Background(), &RequestParams{Service: "missing", Path: "x", Method: "GET"}); !errors.Is(err, ErrUnknownService) {
+		t.Errorf("got %v, want ErrUnknownService", err)
+	}
+}
@@ -0,0 +1,390 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/logging"
+)
+
+// ServiceClient calls other services over a shared, pooled transport.
+// It is meant to be created once per process and is safe for concurrent use.
+type ServiceClient struct {
+	Registry   *ServiceRegistry
+	HTTPClient *http.Client
+
+	// Timeout bounds CallService requests, including reading the body,
+	// unless the service or the request overrides it. Zero means no limit.
+	Timeout time.Duration
+	// TransferTimeout bounds Download and Upload. Zero means no limit.
+	TransferTimeout time.Duration
+
+	// Retry is the default retry policy, nil for no retries.
+	Retry *RetryPolicy
+	// TokenSource, when set, provides the x-service-token of calls that
+	// don't carry one, except calls to serviceAuth. The tokens are issued
+	// through this client and dropped when a call answers 401.
+	TokenSource *ServiceTokenSource
+	// Breaker is the default circuit breaker of every service, nil for none.
+	// It must be set before the first call.
+	Breaker *BreakerSettings
+
+	mu              sync.RWMutex
+	serviceTimeouts map[string]time.Duration
+	retryPolicies   map[string]*RetryPolicy
+	breakerSettings map[string]*BreakerSettings
+	breakers        map[string]*circuitBreaker
+}
+
+// DefaultServiceClient is used by CallService, Download and Upload.
+var DefaultServiceClient = NewServiceClient(DefaultServiceRegistry)
+
+// NewTransport returns an http.Transport tuned for service to service calls.
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          200,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+func NewServiceClient(registry *ServiceRegistry) *ServiceClient {
+	return &ServiceClient{
+		Registry:        registry,
+		HTTPClient:      &http.Client{Transport: NewTransport()},
+		Timeout:         30 * time.Second,
+		TransferTimeout: 10 * time.Minute,
+		serviceTimeouts: map[string]time.Duration{},
+		retryPolicies:   map[string]*RetryPolicy{},
+		breakerSettings: map[string]*BreakerSettings{},
+		breakers:        map[string]*circuitBreaker{},
+	}
+}
+
+// SetServiceTimeout sets the default timeout of calls to a service.
+func (c *ServiceClient) SetServiceTimeout(service string, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serviceTimeouts[service] = timeout
+}
+
+func (c *ServiceClient) timeout(reqOpt *RequestParams) time.Duration {
+	if reqOpt.Timeout != 0 {
+		return reqOpt.Timeout
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if t, ok := c.serviceTimeouts[reqOpt.Service]; ok {
+		return t
+	}
+	return c.Timeout
+}
+
+// withTimeout returns ctx bounded by timeout when it is positive.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// cancelOnClose releases the request context once the body is closed,
+// so the timeout keeps applying while the caller reads the body.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Do sends the request to an instance of reqOpt.Service. When the
+// service has several instances, idempotent requests that fail with a
+// connection error or a 502/503/504 are retried once on each other instance.
+// Failed calls are retried with the call, service or client RetryPolicy, and
+// calls to a service whose circuit breaker is open fail with a
+// *CircuitOpenError. The returned body must be closed.
+func (c *ServiceClient) Do(ctx context.Context, reqOpt *RequestParams) (*http.Response, error) {
+	prepared, err := prepareRequest(reqOpt)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.TokenSource != nil && reqOpt.Service != "serviceAuth" && outgoingHeaderParams(ctx, reqOpt.Header).ServiceToken == "" {
+		token, err := c.TokenSource.token(ctx, c, reqOpt.Service)
+		if err != nil {
+			return nil, err
+		}
+		prepared.serviceToken = token
+	}
+
+	breaker := c.breaker(reqOpt.Service)
+	if breaker != nil {
+		if err := breaker.allow(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := withTimeout(ctx, c.timeout(reqOpt))
+
+	var resp *http.Response
+	if policy := c.retryPolicy(reqOpt); policy != nil && canRetry(reqOpt, prepared) {
+		resp, err = c.sendWithRetry(ctx, policy, reqOpt, prepared)
+	} else {
+		resp, err = c.send(ctx, reqOpt, prepared)
+	}
+	if breaker != nil {
+		if notCalled(err) {
+			breaker.release()
+		} else {
+			breaker.record(err != nil || resp.StatusCode >= 500)
+		}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if prepared.serviceToken != "" && resp.StatusCode == http.StatusUnauthorized {
+		c.TokenSource.Invalidate(reqOpt.Service)
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// send makes one call, failing over to the other instances of the service.
+func (c *ServiceClient) send(ctx context.Context, reqOpt *RequestParams, prepared *preparedRequest) (*http.Response, error) {
+	var tried []*Instance
+	for {
+		instance, err := c.Registry.Pick(reqOpt.Service, tried...)
+		if err != nil {
+			return nil, &pickError{err}
+		}
+		tried = append(tried, instance)
+
+		resp, err := c.callInstance(ctx, instance.URL, reqOpt, prepared)
+		failed := err != nil || instanceFailed(resp.StatusCode)
+		instance.Done(failed)
+
+		n, _ := c.Registry.Instances(reqOpt.Service)
+		if !failed || !canRetry(reqOpt, prepared) || len(tried) >= n || ctx.Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// pickError is a registry error returned before calling any instance.
+type pickError struct {
+	err error
+}
+
+func (e *pickError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pickError) Unwrap() error {
+	return e.err
+}
+
+// notCalled reports whether err says nothing about the health of the
+// service: the caller cancelled the call or no instance could be picked.
+func notCalled(err error) bool {
+	var pe *pickError
+	return errors.Is(err, context.Canceled) || errors.As(err, &pe)
+}
+
+func (c *ServiceClient) callInstance(ctx context.Context, serviceUrl string, reqOpt *RequestParams, prepared *preparedRequest) (*http.Response, error) {
+	url := fmt.Sprintf("%s/%s", serviceUrl, prepared.path)
+	// fmt.Println("CallService:", url, ", Method:", reqOpt.Method)
+	req, err := http.NewRequestWithContext(ctx, reqOpt.Method, url, prepared.reader())
+	if err != nil {
+		return nil, err
+	}
+	h := outgoingHeaderParams(ctx, reqOpt.Header)
+	if h.ServiceToken == "" {
+		h.ServiceToken = prepared.serviceToken
+	}
+	h.ToHeader(req.Header)
+	setTraceHeaders(req, h)
+	if reqOpt.IdempotencyKey != "" {
+		req.Header.Set(IdempotencyKeyHeader, reqOpt.IdempotencyKey)
+	}
+	if prepared.contentType != "" {
+		req.Header.Set("Content-Type", prepared.contentType)
+	}
+
+	return c.HTTPClient.Do(req)
+}
+
+// Download saves the body of a GET to url in dest.
+func (c *ServiceClient) Download(ctx context.Context, url string, dest string, h *HeaderParams) error {
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	ctx, cancel := withTimeout(ctx, c.TransferTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	h = outgoingHeaderParams(ctx, h)
+	h.ToHeader(req.Header)
+	setTraceHeaders(req, h)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	_, err = io.Copy(out, resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Upload posts the file at path to url as the "file" field of a multipart form.
+// The returned body must be closed.
+func (c *ServiceClient) Upload(ctx context.Context, url string, path string, h *HeaderParams) (*http.Response, error) {
+
+	pr, pw := io.Pipe()
+	mpw := multipart.NewWriter(pw)
+
+	errchan := make(chan error, 1)
+
+	go func() {
+
+		defer close(errchan)
+		defer mpw.Close()
+		defer pw.Close()
+
+		w, err := mpw.CreateFormFile("file", filepath.Base(path))
+		if err != nil {
+			errchan <- err
+			return
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			errchan <- err
+			return
+		}
+		defer in.Close()
+
+		if written, err := io.Copy(w, in); err != nil {
+			errchan <- fmt.Errorf("error copying %s (%d bytes written): %v", path, written, err)
+			return
+		}
+
+		if err := mpw.Close(); err != nil {
+			errchan <- err
+			return
+		}
+
+	}()
+
+	ctx, cancel := withTimeout(ctx, c.TransferTimeout)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, pr)
+	if err != nil {
+		cancel()
+		pr.Close()
+		return nil, err
+	}
+	h = outgoingHeaderParams(ctx, h)
+	h.ToHeader(req.Header)
+	setTraceHeaders(req, h)
+	req.Header.Set("Content-Type", mpw.FormDataContentType())
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		// unblock the writer if the request gave up before reading the whole file
+		pr.CloseWithError(err)
+	}
+
+	merr := <-errchan
+
+	if err != nil || merr != nil {
+		logging.FromContext(ctx).Error("upload failed", "url", url, "path", path, "err", err, "multipartErr", merr)
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if merr != nil {
+		resp.Body.Close()
+		cancel()
+		return nil, merr
+	}
+
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// maxErrorBody limits how much of an error response is read into a ServiceError.
+const maxErrorBody = 1 << 20
+
+// DoJSON sends the request and decodes a 2xx JSON response into out, which
+// may be nil to discard it. Other statuses return a *ServiceError.
+// The response body is always closed.
+func (c *ServiceClient) DoJSON(ctx context.Context, reqOpt *RequestParams, out interface{}) error {
+	resp, err := c.Do(ctx, reqOpt)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		raw, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return newServiceError(reqOpt, resp, raw)
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return fmt.Errorf("%s %s: decoding response: %v", reqOpt.Service, reqOpt.Path, err)
+	}
+	return nil
+}
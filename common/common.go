@@ -1,25 +1,40 @@
 package common
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
 	"time"
+
+	"github.com/ahmadIte99/hamdan_common/cache"
+	"github.com/ahmadIte99/hamdan_common/logging"
 )
 
 type RequestParams struct {
 	Service string
 	Path    string
 	Method  string
-	Data    map[string]interface{}
-	Header  *HeaderParams
+	// Data is sent as a JSON body for POST, PUT and PATCH and as query
+	// parameters for other methods.
+	Data map[string]interface{}
+	// Query parameters, added to any query already in Path. Slices add
+	// one parameter per element.
+	Query map[string]interface{}
+	// RawBody or Body replace the JSON body, sent with ContentType.
+	// A streaming Body is never retried.
+	RawBody     []byte
+	Body        io.Reader
+	ContentType string
+	Header      *HeaderParams
+	// Timeout overrides the service client timeout for this call.
+	Timeout time.Duration
+	// Retry overrides the service client retry policy for this call.
+	Retry *RetryPolicy
+	// IdempotencyKey is sent in the Idempotency-Key header and allows
+	// retrying non idempotent methods.
+	IdempotencyKey string
 }
 
 type User struct {
@@ -40,19 +55,33 @@ type Credentials struct {
 	Authentication bool
 	Authorization  bool
 	User           User
-	Err            error
+	// Service is the calling service verified by serviceAuth, for service
+	// tokens. Tenant is the tenant the credentials were verified for, when
+	// the guard, the token or the session names one.
+	Service string
+	Tenant  string
+	Err     error
 }
 
+// HeaderParams are the headers passed between services. The header tag
+// names the header of each field, see FromRequest and ToHeader.
 type HeaderParams struct {
-	Client         string
-	Service        string
-	ServiceToken   string
-	UserId         string
-	AccessToken    string
-	AcceptLanguage string
+	Client         string `header:"x-client"`
+	Service        string `header:"x-service"`
+	ServiceToken   string `header:"x-service-token"`
+	UserId         string `header:"x-user-id"`
+	AccessToken    string `header:"x-access-token"`
+	AcceptLanguage string `header:"accept-language"`
 	// Expire         string
-	Expire                 time.Time `bson:"expire, omitempty" `
-	VideoConvertingOptions string
+	Expire                 time.Time `bson:"expire, omitempty" header:"x-expire"`
+	VideoConvertingOptions string    `header:"x-video-converting-options"`
+	SessionId              string    `header:"x-session-id"`
+	RequestId              string    `header:"x-request-id"`
+	TraceParent            string    `header:"traceparent"`
+	TraceState             string    `header:"tracestate"`
+	// Extra holds the headers registered with RegisterExtensionHeader,
+	// keyed by canonical header name.
+	Extra map[string]string `header:"-"`
 }
 
 type Option struct {
@@ -65,187 +94,114 @@ type OptionResult struct {
 	Option Option
 }
 
+// CallService sends the request through the DefaultServiceClient.
 func CallService(reqOpt *RequestParams) (*http.Response, error) {
-	serviceUrl := GetServiceUrl(reqOpt.Service)
-	path := reqOpt.Path
-	url := fmt.Sprintf("%s/%s", serviceUrl, path)
-	// fmt.Println("CallService:", url, ", Method:", reqOpt.Method)
-	j, _ := json.Marshal(reqOpt.Data)
-	req, err := http.NewRequest(reqOpt.Method, url, bytes.NewBuffer(j))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("x-client", reqOpt.Header.Client)
-	req.Header.Add("x-service", reqOpt.Header.Service)
-	req.Header.Add("x-service-token", reqOpt.Header.ServiceToken)
-	req.Header.Add("x-user-id", reqOpt.Header.UserId)
-	req.Header.Add("x-access-token", reqOpt.Header.AccessToken)
-	req.Header.Add("accept-language", reqOpt.Header.AcceptLanguage)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, errResp := client.Do(req)
-	if errResp != nil {
-		return nil, errResp
-	}
-
-	// fmt.Println("status", resp.StatusCode)
+	return DefaultServiceClient.Do(context.Background(), reqOpt)
+}
 
-	return resp, nil
+// CallServiceContext is CallService bounded by ctx. Outgoing headers are
+// taken from the HeaderParams in ctx, overridden by the non empty fields
+// of reqOpt.Header.
+func CallServiceContext(ctx context.Context, reqOpt *RequestParams) (*http.Response, error) {
+	return DefaultServiceClient.Do(ctx, reqOpt)
+}
 
+// CallServiceJSON calls a service through the DefaultServiceClient and
+// decodes the JSON response into out. Non-2xx responses return a
+// *ServiceError, which can be inspected with errors.As.
+func CallServiceJSON(ctx context.Context, reqOpt *RequestParams, out interface{}) error {
+	return DefaultServiceClient.DoJSON(ctx, reqOpt, out)
 }
 
+// ExtractHeaderParams is FromRequest ignoring a malformed x-expire header.
 func ExtractHeaderParams(r *http.Request) *HeaderParams {
-	p := &HeaderParams{}
-	p.Client = r.Header.Get("x-client")
-	p.Service = r.Header.Get("x-service")
-	p.ServiceToken = r.Header.Get("x-service-token")
-	p.UserId = r.Header.Get("x-user-id")
-	p.AccessToken = r.Header.Get("x-access-token")
-	p.AcceptLanguage = r.Header.Get("accept-language")
-	p.VideoConvertingOptions = r.Header.Get("x-video-converting-options")
-
-	if r.Header.Get("x-expire") != "" {
-		expire, err := time.Parse(time.RFC3339, r.Header.Get("x-expire"))
-		if err != nil {
-			fmt.Println(err)
-		}
-		p.Expire = expire
-	}
-
+	p, _ := FromRequest(r)
 	return p
-
 }
 
+// GetServiceUrl returns the base url of a service from the
+// DefaultServiceRegistry, or an empty string for unknown services.
+//
+// Deprecated: use DefaultServiceRegistry.Lookup, which reports unknown services.
 func GetServiceUrl(name string) string {
-
-	var services = make(map[string]string)
-
-	// manager
-	services["manager"] = getURL("MANAGER_URL", "3030")
-
-	// options
-	services["options"] = getURL("OPTIONS_URL", "3200")
-
-	// users
-	services["users"] = getURL("USERS_URL", "3201")
-
-	//email
-	services["email"] = getURL("EMAIL_URL", "3202")
-
-	// elearning
-	services["elearning"] = getURL("ELEARNING_URL", "3203")
-
-	// files
-	services["files"] = getURL("FILES_URL", "3204")
-
-	//serviceAuth
-	services["serviceAuth"] = getURL("SERVICE_AUTH_URL", "3209")
-
-	//notifications
-	services["notifications"] = getURL("NOTIFICATIONS_URL", "3205")
-
-	//contact
-	services["contact"] = getURL("CONTACT_URL", "3206")
-
-	//cms
-	services["cms"] = getURL("CMS_URL", "3207")
-
-	//ticketing
-	services["ticketing"] = getURL("TICKETING_URL", "3210")
-
-	//types
-	services["types"] = getURL("TYPES_URL", "3212")
-
-	//survey
-	services["survey"] = getURL("SURVEY_URL", "3213")
-
-	//paymentSmartDubaiHelper
-	services["paymentSmartDubaiHelper"] = getURL("SMART_DUBAI_HELPER_PROXY_URL", "9735")
-
-	//payment
-	services["payment"] = getURL("PAYMENT_URL", "3214")
-
-	//newsletter
-	services["newsletter"] = getURL("NEWSLETTER_URL", "3215")
-
-	//imageBuilder
-	services["imageBuilder"] = getURL("IMAGE_BUILDER_URL", "3216")
-
-	//tahkeem
-	services["tahkeem"] = getURL("TAHKEEM_URL", "3217")
-
-	//audit
-	services["audit"] = getURL("AUDIT_URL", "3218")
-
-	//backup
-	services["backup"] = getURL("BACKUP_URL", "3223")
-
-	return services[name]
-
+	url, _ := DefaultServiceRegistry.Lookup(name)
+	return url
 }
 
-func getURL(ename string, port string) string {
-	if url := os.Getenv(ename); url != "" {
-		return url
-	} else {
-		return "http://localhost:" + port
+// Guard authenticates h with serviceAuth/verify for service tokens or
+// users/guard otherwise, and sends the result on c. Access tokens are
+// verified locally when AccessTokenVerifier is set. Results are cached in
+// GuardCredentialsCache when it is set.
+func Guard(c chan Credentials, h *HeaderParams, restrictions []string) {
+	if AccessTokenVerifier != nil && h.ServiceToken == "" && h.AccessToken != "" {
+		res, err := AccessTokenVerifier.Credentials(h, restrictions)
+		if err == nil || !AccessTokenVerifier.FallbackToRemote {
+			res.Err = err
+			c <- res
+			return
+		}
+	}
+	if GuardCredentialsCache == nil {
+		c <- callGuard(h, restrictions)
+		return
 	}
+	if res, ok := GuardCredentialsCache.Get(h, restrictions); ok {
+		c <- res
+		return
+	}
+	res := callGuard(h, restrictions)
+	GuardCredentialsCache.Set(h, restrictions, res)
+	c <- res
 }
 
-func Guard(c chan Credentials, h *HeaderParams, restrictions []string) {
+func callGuard(h *HeaderParams, restrictions []string) Credentials {
 	// fmt.Println("start Guard: ", time.Now())
-	var reqOpt *RequestParams = &RequestParams{}
-	var resp *http.Response
-	var err error
-	var res Credentials
+	var reqOpt *RequestParams = &RequestParams{Method: "POST", Header: h}
 	if h.ServiceToken != "" {
 		reqOpt.Service = "serviceAuth"
 		reqOpt.Path = "verify"
-		reqOpt.Method = "POST"
 		reqOpt.Data = map[string]interface{}{
 			"token": h.ServiceToken,
 		}
-
-		reqOpt.Header = h
-
-		resp, err = CallService(reqOpt)
-		if err != nil || resp.StatusCode != 200 {
-			c <- Credentials{Err: errors.New("not authenticated")}
-			return
-		}
-
-		/*
-		 /*	todo maybe check for decode error
-		*/
-
-		json.NewDecoder(resp.Body).Decode(&res)
-
-		c <- res
-
-		// TODO see one more case //
-
 	} else {
 		reqOpt.Service = "users"
 		reqOpt.Path = "guard"
-		reqOpt.Method = "POST"
 		reqOpt.Data = map[string]interface{}{"restrictions": restrictions}
-		reqOpt.Header = h
-		resp, err = CallService(reqOpt)
-		// fmt.Println("send users/guard Done: ", time.Now())
-		if err != nil || resp.StatusCode != 200 {
-			c <- Credentials{Err: errors.New("not authenticated")}
-			return
-		}
-
-		json.NewDecoder(resp.Body).Decode(&res)
+	}
 
-		c <- res
+	resp, err := CallService(reqOpt)
+	// fmt.Println("send users/guard Done: ", time.Now())
+	if err != nil {
+		return Credentials{Err: newGuardError(ErrUpstreamUnavailable, err)}
+	}
+	defer resp.Body.Close()
 
+	switch {
+	case resp.StatusCode == http.StatusForbidden:
+		return Credentials{Err: newGuardError(ErrForbidden, nil)}
+	case resp.StatusCode >= 500:
+		return Credentials{Err: newGuardError(ErrUpstreamUnavailable, fmt.Errorf("%s/%s: %s", reqOpt.Service, reqOpt.Path, resp.Status))}
+	case resp.StatusCode != http.StatusOK:
+		return Credentials{Err: newGuardError(ErrUnauthenticated, nil)}
 	}
 
+	var res Credentials
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return Credentials{Err: newGuardError(ErrUpstreamUnavailable, err)}
+	}
+	if !res.Authentication {
+		return Credentials{Err: newGuardError(ErrUnauthenticated, nil)}
+	}
+	if !res.Authorization {
+		return Credentials{Authentication: true, User: res.User, Err: newGuardError(ErrForbidden, nil)}
+	}
+	return res
 }
 
+// CommonContextKey is the key GuardMiddleware used to store the user.
+//
+// Deprecated: use UserFromContext, the user is still stored under
+// CommonContextKey("user") for existing callers.
 type CommonContextKey string
 
 // MiddlewareHandler Type
@@ -262,192 +218,117 @@ func MiddlewaresHandler(handler http.Handler, middlewares ...Middleware) http.Ha
 }
 
 func GuardMiddleware(restructions []string) Middleware {
+	return GuardMiddlewareWithSessions(nil, restructions)
+}
+
+// GuardMiddlewareWithSessions is GuardMiddleware with a fast path: requests
+// carrying an x-session-id found in store are authenticated from the session
+// without calling users/guard, as long as the session user has every restriction
+// among its capabilities or roles. The session id alone authenticates the
+// request, unless the session was bound to an x-client with CreateForClient.
+func GuardMiddlewareWithSessions(store *cache.SessionStore, restructions []string) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			c := make(chan Credentials)
-			// fmt.Println("start guardMiddleware Done: ", time.Now())
 			headerParams := ExtractHeaderParams(r)
-			go Guard(c, headerParams, restructions)
-			credentials := <-c
+			credentials, ok := sessionCredentials(store, headerParams, restructions)
+			if !ok {
+				c := make(chan Credentials)
+				// fmt.Println("start guardMiddleware Done: ", time.Now())
+				go Guard(c, headerParams, restructions)
+				credentials = <-c
+			}
 			if credentials.Err != nil {
-				http.Error(w, credentials.Err.Error(), http.StatusBadRequest)
+				writeGuardError(w, r, credentials.Err)
 				return
 			}
-			ctx := context.WithValue(r.Context(), CommonContextKey("user"), credentials.User)
+			ctx := WithCredentials(r.Context(), credentials)
+			ctx = context.WithValue(ctx, CommonContextKey("user"), credentials.User)
+			if credentials.Service != "" {
+				ctx = WithService(ctx, credentials.Service)
+			}
+			if credentials.Tenant != "" {
+				ctx = WithTenant(ctx, credentials.Tenant)
+			}
+			if credentials.User.Id != "" {
+				ctx = logging.WithContext(ctx, logging.FromContext(ctx).With("userId", credentials.User.Id))
+			}
 			// fmt.Println("next of  guardMiddleware: ", time.Now())
 			next.ServeHTTP(w, r.Clone(ctx))
 		})
 	}
 }
 
-// func Log() Middleware {
-// 	return func(next http.Handler) http.Handler {
-// 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 			next.ServeHTTP(w, r)
-// 		})
-// 	}
-// }
-
-func GetOptionValue(option string, h *HeaderParams) (interface{}, error) {
-	var reqOpt *RequestParams = &RequestParams{
-		Service: "options",
-		Path:    option,
-		Method:  "GET",
-		Data:    map[string]interface{}{},
-		Header:  h,
+func sessionCredentials(store *cache.SessionStore, h *HeaderParams, restrictions []string) (Credentials, bool) {
+	if store == nil || h.SessionId == "" || h.ServiceToken != "" {
+		return Credentials{}, false
 	}
-	resp, err := CallService(reqOpt)
+	sess, err := store.Get(h.SessionId)
 	if err != nil {
-		return nil, err
+		return Credentials{}, false
 	}
-
-	if resp.StatusCode == 200 {
-		var res OptionResult
-		decodeErr := json.NewDecoder(resp.Body).Decode(&res)
-		if decodeErr != nil {
-			return nil, decodeErr
-		}
-		return res.Option.Value, nil
+	if sess.Client != "" && sess.Client != h.Client {
+		return Credentials{}, false
 	}
-
-	return nil, nil
-}
-
-func GetServiceToken(service string, h *HeaderParams) (string, error) {
-	var reqOpt *RequestParams = &RequestParams{
-		Service: "serviceAuth",
-		Path:    "issue/" + service,
-		Method:  "POST",
-		Data:    map[string]interface{}{},
-		Header:  h,
+	var user User
+	if err := sess.Decode(&user); err != nil {
+		return Credentials{}, false
 	}
-	resp, err := CallService(reqOpt)
-	if err != nil {
-		return "", err
+	if user.Id == "" {
+		user.Id = sess.UserId
 	}
-
-	type ServiceToken struct {
-		Token string
+	if h.UserId != "" && h.UserId != user.Id {
+		return Credentials{}, false
 	}
-
-	if resp.StatusCode == 200 {
-		var res ServiceToken
-		decodeErr := json.NewDecoder(resp.Body).Decode(&res)
-		if decodeErr != nil {
-			return "", decodeErr
-		}
-		return res.Token, nil
+	if !hasRestrictions(user, restrictions) {
+		return Credentials{}, false
 	}
-
-	return "", nil
+	return Credentials{Authentication: true, Authorization: true, User: user, Tenant: sess.Client}, true
 }
 
-func Download(url string, dest string, h *HeaderParams) error {
-
-	out, err := os.Create(dest)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
+// hasRestrictions reports whether user has every restriction among its
+// capabilities or roles.
+func hasRestrictions(user User, restrictions []string) bool {
+	for _, restriction := range restrictions {
+		if !hasString(user.Capabilities, restriction) && !hasString(user.Roles, restriction) {
+			return false
+		}
 	}
+	return true
+}
 
-	if h != nil {
-		req.Header.Add("x-client", h.Client)
-		req.Header.Add("x-service", h.Service)
-		req.Header.Add("x-service-token", h.ServiceToken)
-		req.Header.Add("x-user-id", h.UserId)
-		req.Header.Add("x-access-token", h.AccessToken)
-		req.Header.Add("accept-language", h.AcceptLanguage)
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
+	return false
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+func GetOptionValue(option string, h *HeaderParams) (interface{}, error) {
+	return GetOptionValueContext(context.Background(), option, h)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
-	}
+func GetServiceToken(service string, h *HeaderParams) (string, error) {
+	return GetServiceTokenContext(context.Background(), service, h)
+}
 
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return err
-	}
+func Download(url string, dest string, h *HeaderParams) error {
+	return DefaultServiceClient.Download(context.Background(), url, dest, h)
+}
 
-	return nil
+// DownloadContext is Download with headers taken from ctx, overridden by
+// the non empty fields of h.
+func DownloadContext(ctx context.Context, url string, dest string, h *HeaderParams) error {
+	return DefaultServiceClient.Download(ctx, url, dest, h)
 }
 
 func Upload(url string, path string, h *HeaderParams) (*http.Response, error) {
+	return DefaultServiceClient.Upload(context.Background(), url, path, h)
+}
 
-	pr, pw := io.Pipe()
-	mpw := multipart.NewWriter(pw)
-
-	errchan := make(chan error)
-
-	go func() {
-
-		defer close(errchan)
-		defer mpw.Close()
-		defer pw.Close()
-
-		w, err := mpw.CreateFormFile("file", filepath.Base(path))
-		if err != nil {
-			errchan <- err
-			return
-		}
-
-		in, err := os.Open(path)
-		if err != nil {
-			errchan <- err
-			return
-		}
-		defer in.Close()
-
-		if written, err := io.Copy(w, in); err != nil {
-			errchan <- fmt.Errorf("error copying %s (%d bytes written): %v", path, written, err)
-			return
-		}
-
-		if err := mpw.Close(); err != nil {
-			errchan <- err
-			return
-		}
-
-	}()
-
-	req, err := http.NewRequest("POST", url, pr)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("x-client", h.Client)
-	req.Header.Add("x-service", h.Service)
-	req.Header.Add("x-service-token", h.ServiceToken)
-	req.Header.Add("x-user-id", h.UserId)
-	req.Header.Add("x-access-token", h.AccessToken)
-	req.Header.Add("accept-language", h.AcceptLanguage)
-	req.Header.Set("Content-Type", mpw.FormDataContentType())
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-
-	merr := <-errchan
-
-	if err != nil || merr != nil {
-		fmt.Println("http error:, multipart error: ", err, merr)
-	}
-
-	if err != nil {
-		return nil, err
-	}
-	if merr != nil {
-		return nil, merr
-	}
-
-	return resp, nil
+// UploadContext is Upload with headers taken from ctx, overridden by the
+// non empty fields of h.
+func UploadContext(ctx context.Context, url string, path string, h *HeaderParams) (*http.Response, error) {
+	return DefaultServiceClient.Upload(ctx, url, path, h)
 }
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/cache"
+	"github.com/ahmadIte99/hamdan_common/cache/cachetest"
+)
+
+// contextProbe records the service and tenant GuardMiddleware stored.
+type contextProbe struct {
+	service, tenant string
+	hasService      bool
+	hasTenant       bool
+}
+
+func (p *contextProbe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.service, p.hasService = ServiceFromContext(r.Context())
+	p.tenant, p.hasTenant = TenantFromContext(r.Context())
+}
+
+func TestGuardMiddlewareServiceFromCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"authentication": true, "authorization": true, "service": "billing",
+		})
+	}))
+	defer srv.Close()
+	old, _ := DefaultServiceRegistry.Service("serviceAuth")
+	DefaultServiceRegistry.Register("serviceAuth", srv.URL)
+	defer DefaultServiceRegistry.RegisterService(old)
+
+	probe := &contextProbe{}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("x-service-token", "token")
+	r.Header.Set("x-service", "admin")
+	r.Header.Set("x-tenant-id", "acme")
+	w := httptest.NewRecorder()
+	GuardMiddleware(nil)(probe).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if probe.service != "billing" {
+		t.Errorf("service: got %q, want the verified billing", probe.service)
+	}
+	if probe.hasTenant {
+		t.Errorf("tenant taken from a header: %q", probe.tenant)
+	}
+}
+
+func TestGuardMiddlewareSessionTenant(t *testing.T) {
+	store := cache.NewSessionStore(cachetest.NewRecorder(), time.Hour)
+	bound, err := store.CreateForClient("u1", "acme", User{Id: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbound, err := store.Create("u1", User{Id: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		session, tenant string
+	}{
+		{bound.Id, "acme"},
+		{unbound.Id, ""},
+	} {
+		probe := &contextProbe{}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("x-session-id", tc.session)
+		r.Header.Set("x-client", "acme")
+		r.Header.Set("x-service", "admin")
+		w := httptest.NewRecorder()
+		GuardMiddlewareWithSessions(store, nil)(probe).ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d", w.Code)
+		}
+		if probe.tenant != tc.tenant || probe.hasService {
+			t.Errorf("got tenant %q and service %q, want tenant %q and no service", probe.tenant, probe.service, tc.tenant)
+		}
+	}
+}
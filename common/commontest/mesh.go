@@ -0,0 +1,225 @@
+// Package commontest runs fake services for testing code that calls other
+// services through the common package.
+package commontest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/ahmadIte99/hamdan_common/common"
+)
+
+// Request is a request received by a fake service.
+type Request struct {
+	Service string
+	Method  string
+	Path    string
+	Query   url.Values
+	Header  http.Header
+	Body    []byte
+}
+
+// Decode unmarshals the JSON body of the request into v.
+func (r Request) Decode(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// Mesh starts an httptest server per named service and registers it in a
+// service registry, common.DefaultServiceRegistry unless set otherwise.
+// Services registered before are restored by Close.
+type Mesh struct {
+	Registry *common.ServiceRegistry
+
+	mu       sync.Mutex
+	servers  map[string]*httptest.Server
+	routes   map[string]map[string]http.Handler
+	muxes    map[string]*http.ServeMux
+	previous map[string]*common.Service
+	requests []Request
+}
+
+// NewMesh returns a Mesh on common.DefaultServiceRegistry closed when the
+// test ends.
+func NewMesh(t testing.TB) *Mesh {
+	m := &Mesh{
+		Registry: common.DefaultServiceRegistry,
+		servers:  map[string]*httptest.Server{},
+		routes:   map[string]map[string]http.Handler{},
+		muxes:    map[string]*http.ServeMux{},
+		previous: map[string]*common.Service{},
+	}
+	t.Cleanup(m.Close)
+	return m
+}
+
+// Close stops the servers and restores the registry.
+func (m *Mesh) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, srv := range m.servers {
+		srv.Close()
+		if prev := m.previous[name]; prev != nil {
+			m.Registry.RegisterService(*prev)
+		} else {
+			m.Registry.Unregister(name)
+		}
+	}
+	m.servers = map[string]*httptest.Server{}
+	m.routes = map[string]map[string]http.Handler{}
+	m.muxes = map[string]*http.ServeMux{}
+	m.previous = map[string]*common.Service{}
+}
+
+// URL returns the base url of a service, starting it if needed.
+func (m *Mesh) URL(service string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.start(service).URL
+}
+
+func (m *Mesh) start(service string) *httptest.Server {
+	if srv, ok := m.servers[service]; ok {
+		return srv
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		m.mu.Lock()
+		m.requests = append(m.requests, Request{
+			Service: service,
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Query:   r.URL.Query(),
+			Header:  r.Header.Clone(),
+			Body:    body,
+		})
+		mux := m.muxes[service]
+		m.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	if prev, ok := m.Registry.Service(service); ok {
+		m.previous[service] = &prev
+	}
+	m.Registry.Register(service, srv.URL)
+	m.servers[service] = srv
+	m.routes[service] = map[string]http.Handler{}
+	m.muxes[service] = http.NewServeMux()
+	return srv
+}
+
+// Handle serves path of service with h, replacing a previous handler of
+// the same path. Patterns follow http.ServeMux.
+func (m *Mesh) Handle(service string, path string, h http.Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.start(service)
+	m.routes[service][path] = h
+	mux := http.NewServeMux()
+	for p, h := range m.routes[service] {
+		mux.Handle(p, h)
+	}
+	m.muxes[service] = mux
+}
+
+// HandleFunc serves path of service with fn.
+func (m *Mesh) HandleFunc(service string, path string, fn func(http.ResponseWriter, *http.Request)) {
+	m.Handle(service, path, http.HandlerFunc(fn))
+}
+
+// Requests returns the requests received by service, or by every service
+// when service is empty.
+func (m *Mesh) Requests(service string) []Request {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var requests []Request
+	for _, r := range m.requests {
+		if service == "" || r.Service == service {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// LastRequest returns the last request received by service.
+func (m *Mesh) LastRequest(service string) (Request, bool) {
+	requests := m.Requests(service)
+	if len(requests) == 0 {
+		return Request{}, false
+	}
+	return requests[len(requests)-1], true
+}
+
+// ResetRequests drops the recorded requests.
+func (m *Mesh) ResetRequests() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = nil
+}
+
+// JSON returns a handler responding with status and v encoded as JSON.
+func JSON(status int, v interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	})
+}
+
+// Status returns a handler responding with status and an empty body.
+func Status(status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+}
+
+// Guard makes users/guard authenticate and authorize every request as user.
+func (m *Mesh) Guard(user common.User) {
+	m.Handle("users", "/guard", JSON(http.StatusOK, common.Credentials{
+		Authentication: true,
+		Authorization:  true,
+		User:           user,
+	}))
+}
+
+// DenyGuard makes users/guard fail with status.
+func (m *Mesh) DenyGuard(status int) {
+	m.Handle("users", "/guard", JSON(status, map[string]string{"message": http.StatusText(status)}))
+}
+
+// VerifyServiceToken makes serviceAuth/verify accept every service token
+// with credentials.
+func (m *Mesh) VerifyServiceToken(credentials common.Credentials) {
+	m.Handle("serviceAuth", "/verify", JSON(http.StatusOK, credentials))
+}
+
+// IssueServiceToken makes serviceAuth/issue/<service> return token.
+func (m *Mesh) IssueServiceToken(token string) {
+	m.Handle("serviceAuth", "/issue/", JSON(http.StatusOK, map[string]string{"token": token}))
+}
+
+// Option makes options/<name> return value.
+func (m *Mesh) Option(name string, value interface{}) {
+	m.Handle("options", "/"+name, JSON(http.StatusOK, common.OptionResult{
+		Option: common.Option{Name: name, Value: value},
+	}))
+}
+
+// Subscriptions makes manager/subscriptions return subscriptions.
+// common.ClientSubscriptionInstance caches subscriptions across requests,
+// reset its SubscriptionData between tests.
+func (m *Mesh) Subscriptions(subscriptions ...common.Subscription) {
+	m.Handle("manager", "/subscriptions", JSON(http.StatusOK, common.Subscriptions{
+		Contents: subscriptions,
+		Pagination: common.Pagination{
+			TotalPages: 1,
+			PerPage:    int64(len(subscriptions)),
+			TotalCount: int64(len(subscriptions)),
+		},
+	}))
+}
@@ -0,0 +1,145 @@
+package commontest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/common"
+	"github.com/ahmadIte99/hamdan_common/common/commontest"
+)
+
+func TestMeshCallService(t *testing.T) {
+	m := commontest.NewMesh(t)
+	m.Handle("orders", "/orders/", commontest.JSON(http.StatusCreated, map[string]string{"id": "o1"}))
+
+	var out map[string]string
+	err := common.CallServiceJSON(context.Background(), &common.RequestParams{
+		Service: "orders",
+		Path:    "orders/new",
+		Method:  "POST",
+		Query:   map[string]interface{}{"dryRun": true},
+		Data:    map[string]interface{}{"item": "book"},
+		Header:  &common.HeaderParams{Client: "acme", UserId: "u1"},
+	}, &out)
+	if err != nil || out["id"] != "o1" {
+		t.Fatalf("got %v, %v", out, err)
+	}
+
+	req, ok := m.LastRequest("orders")
+	if !ok || req.Method != "POST" || req.Path != "/orders/new" || req.Query.Get("dryRun") != "true" {
+		t.Fatalf("got %+v", req)
+	}
+	if req.Header.Get("x-client") != "acme" || req.Header.Get("x-user-id") != "u1" {
+		t.Errorf("headers: got %v", req.Header)
+	}
+	var body map[string]string
+	if err := req.Decode(&body); err != nil || body["item"] != "book" {
+		t.Errorf("body: got %v, %v", body, err)
+	}
+	if len(m.Requests("")) != 1 || len(m.Requests("users")) != 0 {
+		t.Errorf("requests: got %+v", m.Requests(""))
+	}
+	m.ResetRequests()
+	if _, ok := m.LastRequest("orders"); ok {
+		t.Error("requests not reset")
+	}
+}
+
+func TestMeshGuard(t *testing.T) {
+	m := commontest.NewMesh(t)
+	m.Guard(common.User{Id: "u1"})
+
+	var user common.User
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = common.UserFromContext(r.Context())
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("x-access-token", "token")
+	r.Header.Set("x-client", "acme")
+	w := httptest.NewRecorder()
+	common.GuardMiddleware([]string{"orders"})(next).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || user.Id != "u1" {
+		t.Fatalf("got %d, user %+v", w.Code, user)
+	}
+	req, ok := m.LastRequest("users")
+	if !ok || req.Path != "/guard" || req.Header.Get("x-access-token") != "token" || req.Header.Get("x-client") != "acme" {
+		t.Fatalf("got %+v", req)
+	}
+	var body struct{ Restrictions []string }
+	if err := req.Decode(&body); err != nil || len(body.Restrictions) != 1 || body.Restrictions[0] != "orders" {
+		t.Errorf("body: got %+v, %v", body, err)
+	}
+}
+
+func TestMeshOption(t *testing.T) {
+	m := commontest.NewMesh(t)
+	m.Option("theme", "dark")
+
+	v, err := common.GetOptionValue("theme", &common.HeaderParams{Client: "acme"})
+	if err != nil || v != "dark" {
+		t.Fatalf("got %v, %v", v, err)
+	}
+	req, ok := m.LastRequest("options")
+	if !ok || req.Method != "GET" || req.Path != "/theme" || req.Header.Get("x-client") != "acme" {
+		t.Fatalf("got %+v", req)
+	}
+}
+
+func TestMeshSubscriptions(t *testing.T) {
+	m := commontest.NewMesh(t)
+	m.Subscriptions(
+		common.Subscription{Id: "acme", EndDate: time.Now().Add(time.Hour)},
+		common.Subscription{Id: "old", EndDate: time.Now().Add(-time.Hour)},
+	)
+	cs := &common.ClientSubscription{SubscriptionData: map[string]common.Subscription{}}
+	handler := cs.CheckSubscription(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range []struct {
+		client string
+		status int
+	}{
+		{"acme", http.StatusOK},
+		{"old", http.StatusBadRequest},
+		{"unknown", http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("x-client", tt.client)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.client, w.Code, tt.status)
+		}
+	}
+
+	reqs := m.Requests("manager")
+	// acme and old are cached by the first call
+	if len(reqs) != 2 || reqs[0].Path != "/subscriptions" || reqs[0].Header.Get("x-client") != "acme" {
+		t.Fatalf("got %+v", reqs)
+	}
+}
+
+func TestMeshCloseRestoresRegistry(t *testing.T) {
+	registry := common.NewServiceRegistry()
+	registry.Register("options", "http://options.internal")
+	m := commontest.NewMesh(t)
+	m.Registry = registry
+
+	url := m.URL("options")
+	m.URL("orders")
+	if got, _ := registry.Lookup("options"); got != url {
+		t.Fatalf("options: got %q, want the mesh %q", got, url)
+	}
+
+	m.Close()
+	if got, _ := registry.Lookup("options"); got != "http://options.internal" {
+		t.Errorf("options: got %q, want the earlier url", got)
+	}
+	if _, err := registry.Lookup("orders"); !errors.Is(err, common.ErrUnknownService) {
+		t.Errorf("orders: got %v, want ErrUnknownService", err)
+	}
+}
@@ -0,0 +1,179 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+)
+
+type headerParamsKey struct{}
+
+// WithHeaderParams returns a copy of ctx carrying h.
+func WithHeaderParams(ctx context.Context, h *HeaderParams) context.Context {
+	return context.WithValue(ctx, headerParamsKey{}, h)
+}
+
+// HeaderParamsFromContext returns the HeaderParams stored by
+// HeaderParamsMiddleware or WithHeaderParams.
+func HeaderParamsFromContext(ctx context.Context) (*HeaderParams, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	h, ok := ctx.Value(headerParamsKey{}).(*HeaderParams)
+	return h, ok && h != nil
+}
+
+// HeaderParamsMiddleware stores the HeaderParams of the request in its
+// context, where the context variants of the call helpers pick them up.
+func HeaderParamsMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithHeaderParams(r.Context(), ExtractHeaderParams(r))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// outgoingHeaderParams returns the HeaderParams from ctx with the non zero
+// fields of overrides applied, Extra merged by name. The result is a copy,
+// including Extra, and may be modified.
+func outgoingHeaderParams(ctx context.Context, overrides *HeaderParams) *HeaderParams {
+	h := &HeaderParams{}
+	if fromCtx, ok := HeaderParamsFromContext(ctx); ok {
+		*h = *fromCtx
+	}
+	extra := make(map[string]string, len(h.Extra))
+	for name, value := range h.Extra {
+		extra[name] = value
+	}
+	if overrides != nil {
+		dst := reflect.ValueOf(h).Elem()
+		src := reflect.ValueOf(overrides).Elem()
+		for i := 0; i < src.NumField(); i++ {
+			if f := src.Field(i); !f.IsZero() {
+				dst.Field(i).Set(f)
+			}
+		}
+		for name, value := range overrides.Extra {
+			extra[name] = value
+		}
+	}
+	h.Extra = nil
+	if len(extra) > 0 {
+		h.Extra = extra
+	}
+	return h
+}
+
+// GetOptionValueContext is GetOptionValue with headers taken from ctx,
+// overridden by the non empty fields of h.
+func GetOptionValueContext(ctx context.Context, option string, h *HeaderParams) (interface{}, error) {
+	var reqOpt *RequestParams = &RequestParams{
+		Service: "options",
+		Path:    option,
+		Method:  "GET",
+		Data:    map[string]interface{}{},
+		Header:  h,
+	}
+	var res OptionResult
+	if err := CallServiceJSON(ctx, reqOpt, &res); err != nil {
+		var serviceErr *ServiceError
+		if errors.As(err, &serviceErr) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return res.Option.Value, nil
+}
+
+// GetServiceTokenContext is GetServiceToken with headers taken from ctx,
+// overridden by the non empty fields of h. Non-2xx answers return a
+// *ServiceError.
+func GetServiceTokenContext(ctx context.Context, service string, h *HeaderParams) (string, error) {
+	var reqOpt *RequestParams = &RequestParams{
+		Service: "serviceAuth",
+		Path:    "issue/" + service,
+		Method:  "POST",
+		Data:    map[string]interface{}{},
+		Header:  h,
+	}
+
+	type ServiceToken struct {
+		Token string
+	}
+
+	var res ServiceToken
+	if err := CallServiceJSON(ctx, reqOpt, &res); err != nil {
+		return "", err
+	}
+	return res.Token, nil
+}
+
+type (
+	userKey        struct{}
+	credentialsKey struct{}
+	serviceKey     struct{}
+	tenantKey      struct{}
+)
+
+// WithUser returns a copy of ctx carrying user.
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFromContext returns the user stored by GuardMiddleware or WithUser.
+func UserFromContext(ctx context.Context) (User, bool) {
+	if user, ok := ctx.Value(userKey{}).(User); ok {
+		return user, true
+	}
+	// set by code predating WithUser
+	user, ok := ctx.Value(CommonContextKey("user")).(User)
+	return user, ok
+}
+
+// MustUser is UserFromContext for handlers behind GuardMiddleware. It
+// panics when ctx carries no user.
+func MustUser(ctx context.Context) User {
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		panic("common: no user in context, is the handler behind GuardMiddleware?")
+	}
+	return user
+}
+
+// WithCredentials returns a copy of ctx carrying the credentials and their user.
+func WithCredentials(ctx context.Context, c Credentials) context.Context {
+	return WithUser(context.WithValue(ctx, credentialsKey{}, c), c.User)
+}
+
+// CredentialsFromContext returns the credentials stored by GuardMiddleware
+// or WithCredentials.
+func CredentialsFromContext(ctx context.Context) (Credentials, bool) {
+	c, ok := ctx.Value(credentialsKey{}).(Credentials)
+	return c, ok
+}
+
+// WithService returns a copy of ctx carrying the name of the calling service.
+func WithService(ctx context.Context, service string) context.Context {
+	return context.WithValue(ctx, serviceKey{}, service)
+}
+
+// ServiceFromContext returns the calling service verified by serviceAuth
+// for requests authenticated by GuardMiddleware with a service token.
+func ServiceFromContext(ctx context.Context) (string, bool) {
+	s, ok := ctx.Value(serviceKey{}).(string)
+	return s, ok
+}
+
+// WithTenant returns a copy of ctx carrying tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of the request, taken by
+// GuardMiddleware from the verified Credentials.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	t, ok := ctx.Value(tenantKey{}).(string)
+	return t, ok && t != ""
+}
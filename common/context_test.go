@@ -0,0 +1,21 @@
+package common
+
+import (
+	"context"
+	"testing"
+)
+
+func TestOutgoingHeaderParamsCopiesExtra(t *testing.T) {
+	fromCtx := &HeaderParams{AcceptLanguage: "en", Extra: map[string]string{"x-a": "1", "x-b": "1"}}
+	ctx := WithHeaderParams(context.Background(), fromCtx)
+
+	h := outgoingHeaderParams(ctx, &HeaderParams{AcceptLanguage: "ar", Extra: map[string]string{"x-b": "2"}})
+	h.Extra["x-c"] = "3"
+
+	if h.AcceptLanguage != "ar" || h.Extra["x-a"] != "1" || h.Extra["x-b"] != "2" {
+		t.Errorf("got %+v", h)
+	}
+	if len(fromCtx.Extra) != 2 || fromCtx.Extra["x-b"] != "1" {
+		t.Errorf("context params modified: %+v", fromCtx.Extra)
+	}
+}
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ServiceError is returned by CallServiceJSON for non-2xx responses.
+type ServiceError struct {
+	Service    string
+	Method     string
+	URL        string
+	StatusCode int
+	// Message is taken from the "message" or "error" field of a JSON
+	// error body, the message of a WriteError envelope, or is the plain
+	// text body.
+	Message string
+	// Body is the parsed JSON error body, nil when it is not JSON.
+	Body map[string]interface{}
+	Raw  []byte
+}
+
+func (e *ServiceError) Error() string {
+	msg := fmt.Sprintf("%s %s %s: %d %s", e.Service, e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func newServiceError(reqOpt *RequestParams, resp *http.Response, raw []byte) *ServiceError {
+	e := &ServiceError{
+		Service:    reqOpt.Service,
+		Method:     reqOpt.Method,
+		StatusCode: resp.StatusCode,
+		Raw:        raw,
+	}
+	if resp.Request != nil {
+		e.URL = resp.Request.URL.String()
+	}
+	if err := json.Unmarshal(raw, &e.Body); err == nil {
+		for _, field := range []string{"message", "error"} {
+			if msg, ok := e.Body[field].(string); ok {
+				e.Message = msg
+				break
+			}
+		}
+		if envelope, ok := e.Body["error"].(map[string]interface{}); ok && e.Message == "" {
+			// the envelope written by WriteError
+			e.Message, _ = envelope["message"].(string)
+		}
+	} else {
+		e.Body = nil
+		e.Message = strings.TrimSpace(string(raw))
+	}
+	return e
+}
+
+// Guard failures, matched with errors.Is against a *GuardError.
+var (
+	ErrUnauthenticated     = errors.New("not authenticated")
+	ErrForbidden           = errors.New("forbidden")
+	ErrUpstreamUnavailable = errors.New("authentication service unavailable")
+)
+
+// GuardError is the Credentials.Err set by Guard. Kind is one of
+// ErrUnauthenticated, ErrForbidden or ErrUpstreamUnavailable.
+type GuardError struct {
+	Kind  error
+	Cause error
+}
+
+func newGuardError(kind error, cause error) *GuardError {
+	return &GuardError{Kind: kind, Cause: cause}
+}
+
+func (e *GuardError) Error() string {
+	if e.Cause != nil {
+		return e.Kind.Error() + ": " + e.Cause.Error()
+	}
+	return e.Kind.Error()
+}
+
+func (e *GuardError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *GuardError) Unwrap() error {
+	return e.Cause
+}
+
+// GuardErrorStatus maps a Guard error to 401, 403 or 503.
+func GuardErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusUnauthorized
+}
+
+// guardErrorCode is the machine readable code of a Guard error.
+func guardErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrForbidden):
+		return "forbidden"
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return "unavailable"
+	}
+	return "unauthenticated"
+}
+
+func writeGuardError(w http.ResponseWriter, r *http.Request, err error) {
+	message := err.Error()
+	var guardErr *GuardError
+	if errors.As(err, &guardErr) {
+		// don't leak upstream details to clients
+		message = guardErr.Kind.Error()
+	}
+	WriteError(w, r, NewAPIError(GuardErrorStatus(err), guardErrorCode(err), message))
+}
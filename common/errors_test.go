@@ -0,0 +1,110 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDoJSONServiceError(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		message string
+		json    bool
+	}{
+		{"message field", 400, `{"message":"bad name","field":"name"}`, "bad name", true},
+		{"error field", 404, `{"error":"no such user"}`, "no such user", true},
+		{"message before error", 409, `{"error":"conflict","message":"taken"}`, "taken", true},
+		{"WriteError envelope", 422, `{"error":{"code":"invalid","message":"bad email"}}`, "bad email", true},
+		{"JSON without message", 500, `{"code":7}`, "", true},
+		{"plain text", 502, "upstream down\n", "upstream down", false},
+		{"empty body", 503, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+			registry := NewServiceRegistry()
+			registry.Register("users", srv.URL)
+			c := NewServiceClient(registry)
+
+			var out map[string]interface{}
+			err := c.DoJSON(context.Background(), &RequestParams{Service: "users", Path: "u/1", Method: "GET"}, &out)
+			var se *ServiceError
+			if !errors.As(err, &se) {
+				t.Fatalf("got %v, want a *ServiceError", err)
+			}
+			if se.StatusCode != tt.status || se.Message != tt.message || se.Service != "users" || se.Method != "GET" ||
+				se.URL != srv.URL+"/u/1" || string(se.Raw) != tt.body || (se.Body != nil) != tt.json {
+				t.Fatalf("got %+v", se)
+			}
+			if tt.message != "" && !strings.HasSuffix(err.Error(), ": "+tt.message) {
+				t.Errorf("Error() = %q", err.Error())
+			}
+			if out != nil {
+				t.Errorf("out decoded from an error: %v", out)
+			}
+		})
+	}
+}
+
+func TestDoJSONSuccess(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"decodes the body", 200, `{"name":"a"}`, "a"},
+		{"no content", 204, "", ""},
+		{"empty body", 200, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+			registry := NewServiceRegistry()
+			registry.Register("users", srv.URL)
+			c := NewServiceClient(registry)
+
+			var out struct{ Name string }
+			if err := c.DoJSON(context.Background(), &RequestParams{Service: "users", Path: "u", Method: "GET"}, &out); err != nil {
+				t.Fatal(err)
+			}
+			if out.Name != tt.want {
+				t.Fatalf("got %q, want %q", out.Name, tt.want)
+			}
+			if err := c.DoJSON(context.Background(), &RequestParams{Service: "users", Path: "u", Method: "GET"}, nil); err != nil {
+				t.Fatalf("nil out: %v", err)
+			}
+		})
+	}
+}
+
+func TestDoJSONInvalidBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>")
+	}))
+	defer srv.Close()
+	registry := NewServiceRegistry()
+	registry.Register("users", srv.URL)
+
+	var out map[string]interface{}
+	err := NewServiceClient(registry).DoJSON(context.Background(), &RequestParams{Service: "users", Path: "u", Method: "GET"}, &out)
+	var se *ServiceError
+	if err == nil || errors.As(err, &se) || !strings.Contains(err.Error(), "decoding response") {
+		t.Fatalf("got %v", err)
+	}
+}
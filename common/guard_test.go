@@ -0,0 +1,83 @@
+package common_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ahmadIte99/hamdan_common/common"
+	"github.com/ahmadIte99/hamdan_common/common/commontest"
+)
+
+func TestGuardMiddlewareStatus(t *testing.T) {
+	closed := httptest.NewServer(nil)
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		guard   func(m *commontest.Mesh)
+		service bool
+		status  int
+		code    string
+	}{
+		{"allowed", func(m *commontest.Mesh) { m.Guard(common.User{Id: "u1"}) }, false, 200, ""},
+		{"upstream 401", func(m *commontest.Mesh) { m.DenyGuard(401) }, false, 401, "unauthenticated"},
+		{"upstream 403", func(m *commontest.Mesh) { m.DenyGuard(403) }, false, 403, "forbidden"},
+		{"upstream 500", func(m *commontest.Mesh) { m.DenyGuard(500) }, false, 503, "unavailable"},
+		{"upstream 502", func(m *commontest.Mesh) { m.DenyGuard(502) }, false, 503, "unavailable"},
+		{"invalid body", func(m *commontest.Mesh) {
+			m.Handle("users", "/guard", commontest.Status(http.StatusOK))
+		}, false, 503, "unavailable"},
+		{"network error", func(m *commontest.Mesh) {
+			m.URL("users")
+			m.Registry.Register("users", closed.URL)
+		}, false, 503, "unavailable"},
+		{"not authenticated", func(m *commontest.Mesh) {
+			m.Handle("users", "/guard", commontest.JSON(http.StatusOK, common.Credentials{Authorization: true}))
+		}, false, 401, "unauthenticated"},
+		{"not authorized", func(m *commontest.Mesh) {
+			m.Handle("users", "/guard", commontest.JSON(http.StatusOK, common.Credentials{Authentication: true}))
+		}, false, 403, "forbidden"},
+		{"service token rejected", func(m *commontest.Mesh) {
+			m.Handle("serviceAuth", "/verify", commontest.Status(http.StatusUnauthorized))
+		}, true, 401, "unauthenticated"},
+		{"service token unavailable", func(m *commontest.Mesh) {
+			m.Handle("serviceAuth", "/verify", commontest.Status(http.StatusServiceUnavailable))
+		}, true, 503, "unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := commontest.NewMesh(t)
+			tt.guard(m)
+
+			called := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("x-access-token", "token")
+			if tt.service {
+				r.Header.Set("x-service-token", "token")
+			}
+			w := httptest.NewRecorder()
+			common.GuardMiddleware([]string{"orders"})(next).ServeHTTP(w, r)
+
+			if w.Code != tt.status || called != (tt.status == 200) {
+				t.Fatalf("got %d, handler called %v, want %d", w.Code, called, tt.status)
+			}
+			if tt.status == 200 {
+				return
+			}
+			var body struct {
+				Error common.APIError `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q: %v", w.Body.String(), err)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" || body.Error.Code != tt.code || body.Error.Message == "" {
+				t.Fatalf("got %s %s", ct, w.Body.String())
+			}
+		})
+	}
+}
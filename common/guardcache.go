@@ -0,0 +1,279 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/cache"
+)
+
+// GuardCredentialsCache, when set, caches the results of Guard.
+var GuardCredentialsCache *GuardCache
+
+// GuardCache caches Guard credentials per token, client, user and
+// restriction set, either in process or in a shared cache.Cache.
+// Successful results are kept for TTL and failures for NegativeTTL,
+// which should stay small; zero disables caching failures.
+type GuardCache struct {
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	// Cache stores the entries when set, otherwise they are kept in process.
+	// Entries in Cache only keep the id, roles and capabilities of the user.
+	Cache  cache.Cache
+	Prefix string
+	// StoreFullUser keeps the whole user, with its email and birthday, in
+	// Cache too. Wrap Cache with cache.NewEncryptedCache when setting it.
+	StoreFullUser bool
+	// MaxEntries bounds the in process entries, zero means no limit. When
+	// full, the entry expiring first is evicted.
+	MaxEntries int
+	// SweepInterval is how often Set drops the expired in process entries.
+	SweepInterval time.Duration
+
+	mu    sync.Mutex
+	local map[string]guardEntry
+	swept time.Time
+}
+
+type guardEntry struct {
+	Credentials Credentials `json:"credentials"`
+	Failed      bool        `json:"failed,omitempty"`
+	Status      int         `json:"status,omitempty"`
+	UserId      string      `json:"userId,omitempty"`
+	Expires     time.Time   `json:"expires"`
+}
+
+// NewGuardCache returns an in process GuardCache.
+func NewGuardCache(ttl time.Duration, negativeTTL time.Duration) *GuardCache {
+	return &GuardCache{
+		TTL:           ttl,
+		NegativeTTL:   negativeTTL,
+		Prefix:        "guard",
+		MaxEntries:    10000,
+		SweepInterval: time.Minute,
+		local:         map[string]guardEntry{},
+	}
+}
+
+// NewSharedGuardCache returns a GuardCache storing entries in c. Cached
+// credentials carry only the id, roles and capabilities of their user, see
+// StoreFullUser.
+func NewSharedGuardCache(c cache.Cache, ttl time.Duration, negativeTTL time.Duration) *GuardCache {
+	g := NewGuardCache(ttl, negativeTTL)
+	g.Cache = c
+	return g
+}
+
+func hashKey(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// tokenHash identifies the token of h, empty when h carries none.
+func tokenHash(h *HeaderParams) string {
+	switch {
+	case h.ServiceToken != "":
+		return hashKey("service", h.ServiceToken)
+	case h.AccessToken != "":
+		return hashKey("access", h.AccessToken)
+	}
+	return ""
+}
+
+func (g *GuardCache) key(h *HeaderParams, restrictions []string) string {
+	token := tokenHash(h)
+	if token == "" {
+		return ""
+	}
+	sorted := append([]string(nil), restrictions...)
+	sort.Strings(sorted)
+	return g.Prefix + ":" + token + ":" + hashKey(append([]string{h.Client, h.UserId}, sorted...)...)
+}
+
+func (g *GuardCache) userKey(userId string, key string) string {
+	return g.Prefix + ":user:" + userId + ":" + strings.TrimPrefix(key, g.Prefix+":")
+}
+
+// Get returns cached credentials for h and restrictions.
+func (g *GuardCache) Get(h *HeaderParams, restrictions []string) (Credentials, bool) {
+	key := g.key(h, restrictions)
+	if key == "" {
+		return Credentials{}, false
+	}
+	var e guardEntry
+	if g.Cache != nil {
+		val, err := g.Cache.GetByKey(key)
+		if err != nil || json.Unmarshal([]byte(val), &e) != nil {
+			return Credentials{}, false
+		}
+	} else {
+		g.mu.Lock()
+		var ok bool
+		e, ok = g.local[key]
+		if ok && !time.Now().Before(e.Expires) {
+			delete(g.local, key)
+			ok = false
+		}
+		g.mu.Unlock()
+		if !ok {
+			return Credentials{}, false
+		}
+	}
+	if e.Failed {
+		kind := ErrUnauthenticated
+		if e.Status == http.StatusForbidden {
+			kind = ErrForbidden
+		}
+		return Credentials{Err: newGuardError(kind, nil)}, true
+	}
+	return e.Credentials, true
+}
+
+// Set caches the result of Guard for h and restrictions.
+func (g *GuardCache) Set(h *HeaderParams, restrictions []string, res Credentials) {
+	key := g.key(h, restrictions)
+	if key == "" {
+		return
+	}
+	ttl := g.TTL
+	e := guardEntry{Credentials: res, UserId: res.User.Id}
+	if res.Err != nil {
+		if errors.Is(res.Err, ErrUpstreamUnavailable) {
+			// only the answer of the guard is cached, not its outages
+			return
+		}
+		ttl = g.NegativeTTL
+		e = guardEntry{Failed: true, Status: GuardErrorStatus(res.Err)}
+	}
+	if ttl <= 0 {
+		return
+	}
+	e.Credentials.Err = nil
+	e.Expires = time.Now().Add(ttl)
+
+	if g.Cache != nil {
+		if !g.StoreFullUser {
+			e.Credentials.User = guardUser(e.Credentials.User)
+		}
+		g.Cache.CacheByKey(key, e, ttl)
+		if e.UserId != "" {
+			g.Cache.CacheByKey(g.userKey(e.UserId, key), key, ttl)
+		}
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.local == nil {
+		g.local = map[string]guardEntry{}
+	}
+	now := time.Now()
+	if !now.Before(g.swept.Add(g.SweepInterval)) {
+		g.sweep(now)
+	}
+	if _, found := g.local[key]; !found && g.MaxEntries > 0 && len(g.local) >= g.MaxEntries {
+		g.sweep(now)
+		if len(g.local) >= g.MaxEntries {
+			g.evict()
+		}
+	}
+	g.local[key] = e
+}
+
+// guardUser keeps the fields of u the guard checks.
+func guardUser(u User) User {
+	return User{Id: u.Id, Roles: u.Roles, Capabilities: u.Capabilities}
+}
+
+// Sweep drops the expired in process entries. Set already does it every
+// SweepInterval.
+func (g *GuardCache) Sweep() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweep(time.Now())
+}
+
+// sweep drops the entries expired at now. g.mu must be held.
+func (g *GuardCache) sweep(now time.Time) {
+	for k, e := range g.local {
+		if !now.Before(e.Expires) {
+			delete(g.local, k)
+		}
+	}
+	g.swept = now
+}
+
+// evict drops the entry expiring first. g.mu must be held.
+func (g *GuardCache) evict() {
+	var oldest string
+	var expires time.Time
+	for k, e := range g.local {
+		if oldest == "" || e.Expires.Before(expires) {
+			oldest, expires = k, e.Expires
+		}
+	}
+	delete(g.local, oldest)
+}
+
+// InvalidateToken drops the entries of an access or service token, e.g.
+// when a logout event is received.
+func (g *GuardCache) InvalidateToken(token string) {
+	for _, h := range []*HeaderParams{{AccessToken: token}, {ServiceToken: token}} {
+		prefix := g.Prefix + ":" + tokenHash(h) + ":"
+		if g.Cache != nil {
+			g.Cache.BatchDeletionKeysByPattern(prefix+"*", 100)
+			continue
+		}
+		g.mu.Lock()
+		for k := range g.local {
+			if strings.HasPrefix(k, prefix) {
+				delete(g.local, k)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// InvalidateUser drops the entries of every token of a user, e.g. on a
+// "log out everywhere" event.
+func (g *GuardCache) InvalidateUser(userId string) {
+	if userId == "" {
+		return
+	}
+	if g.Cache != nil {
+		prefix := g.Prefix + ":user:" + userId + ":"
+		keys, err := g.Cache.GetKeysByPattern(prefix+"*", 100)
+		if err != nil {
+			return
+		}
+		for _, k := range keys {
+			g.Cache.DeleteKey(g.Prefix + ":" + strings.TrimPrefix(k, prefix))
+			g.Cache.DeleteKey(k)
+		}
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for k, e := range g.local {
+		if e.UserId == userId {
+			delete(g.local, k)
+		}
+	}
+}
+
+// InvalidateAll drops every entry.
+func (g *GuardCache) InvalidateAll() {
+	if g.Cache != nil {
+		g.Cache.BatchDeletionKeysByPattern(g.Prefix+":*", 100)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.local = map[string]guardEntry{}
+}
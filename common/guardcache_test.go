@@ -0,0 +1,90 @@
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/cache/cachetest"
+)
+
+func TestGuardCacheMaxEntries(t *testing.T) {
+	g := NewGuardCache(time.Minute, 0)
+	g.MaxEntries = 3
+	for i := 0; i < 5; i++ {
+		h := &HeaderParams{AccessToken: fmt.Sprint("token", i)}
+		g.Set(h, nil, Credentials{User: User{Id: fmt.Sprint(i)}})
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(g.local); n != 3 {
+		t.Fatalf("got %d entries, want 3", n)
+	}
+	if _, ok := g.Get(&HeaderParams{AccessToken: "token0"}, nil); ok {
+		t.Error("oldest entry not evicted")
+	}
+	if c, ok := g.Get(&HeaderParams{AccessToken: "token4"}, nil); !ok || c.User.Id != "4" {
+		t.Errorf("newest entry: got %+v, %v", c, ok)
+	}
+}
+
+func TestGuardCacheSweep(t *testing.T) {
+	g := NewGuardCache(time.Millisecond, 0)
+	g.SweepInterval = time.Hour
+	g.Set(&HeaderParams{AccessToken: "a"}, nil, Credentials{})
+	g.Set(&HeaderParams{AccessToken: "b"}, nil, Credentials{})
+	time.Sleep(5 * time.Millisecond)
+
+	g.TTL = time.Minute
+	g.Set(&HeaderParams{AccessToken: "c"}, nil, Credentials{})
+	if n := len(g.local); n != 3 {
+		t.Fatalf("swept before SweepInterval: %d entries", n)
+	}
+	g.Sweep()
+	if n := len(g.local); n != 1 {
+		t.Fatalf("got %d entries after Sweep, want 1", n)
+	}
+
+	g.TTL = time.Millisecond
+	g.SweepInterval = 0
+	g.Set(&HeaderParams{AccessToken: "d"}, nil, Credentials{})
+	time.Sleep(5 * time.Millisecond)
+	g.Set(&HeaderParams{AccessToken: "e"}, nil, Credentials{})
+	if _, found := g.local[g.key(&HeaderParams{AccessToken: "d"}, nil)]; found {
+		t.Error("expired entry not swept by Set")
+	}
+}
+
+func TestSharedGuardCacheStoresGuardFields(t *testing.T) {
+	user := User{
+		Id:           "u1",
+		Email:        "u1@example.com",
+		Birthday:     time.Date(1990, 1, 2, 0, 0, 0, 0, time.UTC),
+		FirstName:    "Ann",
+		Roles:        []string{"admin"},
+		Capabilities: []string{"orders"},
+	}
+	h := &HeaderParams{AccessToken: "token"}
+
+	rec := cachetest.NewRecorder()
+	g := NewSharedGuardCache(rec, time.Minute, 0)
+	g.Set(h, nil, Credentials{Authentication: true, Authorization: true, Tenant: "acme", User: user})
+	for _, k := range rec.Keys() {
+		val, _ := rec.GetByKey(k)
+		if strings.Contains(val, "example.com") || strings.Contains(val, "1990") || strings.Contains(val, "Ann") {
+			t.Fatalf("%s stores personal data: %s", k, val)
+		}
+	}
+	c, ok := g.Get(h, nil)
+	want := User{Id: "u1", Roles: []string{"admin"}, Capabilities: []string{"orders"}}
+	if !ok || !c.Authentication || !c.Authorization || c.Tenant != "acme" || !reflect.DeepEqual(c.User, want) {
+		t.Fatalf("got %+v, %v", c, ok)
+	}
+
+	g.StoreFullUser = true
+	g.Set(h, nil, Credentials{Authentication: true, Authorization: true, User: user})
+	if c, ok := g.Get(h, nil); !ok || c.User.Email != user.Email || !c.User.Birthday.Equal(user.Birthday) {
+		t.Fatalf("StoreFullUser: got %+v, %v", c, ok)
+	}
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type headerField struct {
+	index int
+	name  string
+}
+
+// headerFields is the header tag mapping of HeaderParams.
+var headerFields = func() []headerField {
+	var fields []headerField
+	t := reflect.TypeOf(HeaderParams{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("header"); name != "" && name != "-" {
+			fields = append(fields, headerField{index: i, name: name})
+		}
+	}
+	return fields
+}()
+
+var (
+	extensionMu      sync.RWMutex
+	extensionHeaders = map[string]bool{}
+)
+
+// RegisterExtensionHeader makes FromRequest read the named headers into
+// HeaderParams.Extra, and ToHeader write them back.
+func RegisterExtensionHeader(names ...string) {
+	extensionMu.Lock()
+	defer extensionMu.Unlock()
+	for _, name := range names {
+		extensionHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+}
+
+// FromRequest reads the HeaderParams of r. A malformed x-expire header
+// returns an error together with the other params.
+func FromRequest(r *http.Request) (*HeaderParams, error) {
+	p := &HeaderParams{}
+	v := reflect.ValueOf(p).Elem()
+	var err error
+	for _, f := range headerFields {
+		value := r.Header.Get(f.name)
+		if value == "" {
+			continue
+		}
+		switch field := v.Field(f.index); field.Interface().(type) {
+		case time.Time:
+			t, perr := time.Parse(time.RFC3339, value)
+			if perr != nil {
+				err = fmt.Errorf("invalid %s header: %v", f.name, perr)
+				continue
+			}
+			field.Set(reflect.ValueOf(t))
+		default:
+			field.SetString(value)
+		}
+	}
+
+	extensionMu.RLock()
+	defer extensionMu.RUnlock()
+	for name := range extensionHeaders {
+		if value := r.Header.Get(name); value != "" {
+			if p.Extra == nil {
+				p.Extra = map[string]string{}
+			}
+			p.Extra[name] = value
+		}
+	}
+	return p, err
+}
+
+// ToHeader sets the non empty params, including Extra, on header.
+func (h *HeaderParams) ToHeader(header http.Header) {
+	if h == nil {
+		return
+	}
+	v := reflect.ValueOf(h).Elem()
+	for _, f := range headerFields {
+		switch value := v.Field(f.index).Interface().(type) {
+		case time.Time:
+			if !value.IsZero() {
+				header.Set(f.name, value.Format(time.RFC3339))
+			}
+		case string:
+			if value != "" {
+				header.Set(f.name, value)
+			}
+		}
+	}
+	for name, value := range h.Extra {
+		header.Set(name, value)
+	}
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeaderParamsRoundTrip(t *testing.T) {
+	want := &HeaderParams{
+		Client:                 "acme",
+		Service:                "billing",
+		ServiceToken:           "st",
+		UserId:                 "u1",
+		AccessToken:            "at",
+		AcceptLanguage:         "ar",
+		Expire:                 time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		VideoConvertingOptions: "720p",
+		SessionId:              "s1",
+		RequestId:              "req-1",
+		TraceParent:            "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		TraceState:             "k=v",
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	want.ToHeader(r.Header)
+	if got := r.Header.Get("x-expire"); got != "2030-01-02T03:04:05Z" {
+		t.Errorf("x-expire: got %q", got)
+	}
+
+	got, err := FromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestHeaderParamsEmpty(t *testing.T) {
+	header := http.Header{}
+	(&HeaderParams{}).ToHeader(header)
+	(*HeaderParams)(nil).ToHeader(header)
+	if len(header) != 0 {
+		t.Fatalf("got %v", header)
+	}
+	got, err := FromRequest(httptest.NewRequest("GET", "/", nil))
+	if err != nil || !reflect.DeepEqual(got, &HeaderParams{}) {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+}
+
+func TestFromRequestInvalidExpire(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("x-expire", "tomorrow")
+	r.Header.Set("x-user-id", "u1")
+
+	h, err := FromRequest(r)
+	if err == nil || !strings.Contains(err.Error(), "x-expire") {
+		t.Fatalf("got %v, want an x-expire error", err)
+	}
+	if h.UserId != "u1" || !h.Expire.IsZero() {
+		t.Fatalf("got %+v, want the other params", h)
+	}
+	if ExtractHeaderParams(r).UserId != "u1" {
+		t.Fatal("ExtractHeaderParams dropped the params")
+	}
+}
+
+func TestExtensionHeaders(t *testing.T) {
+	RegisterExtensionHeader("x-test-region", "X-Test-Plan")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-TEST-REGION", "eu")
+	r.Header.Set("x-test-unregistered", "1")
+	h, err := FromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h.Extra, map[string]string{"X-Test-Region": "eu"}) {
+		t.Fatalf("Extra: got %v", h.Extra)
+	}
+
+	h.Extra["X-Test-Plan"] = "pro"
+	header := http.Header{}
+	h.ToHeader(header)
+	if header.Get("x-test-region") != "eu" || header.Get("x-test-plan") != "pro" || header.Get("x-test-unregistered") != "" {
+		t.Fatalf("got %v", header)
+	}
+}
@@ -0,0 +1,264 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/logging"
+)
+
+// ErrUnknownKey is returned for tokens signed with a key missing from the key source.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// StaticKeys is a fixed set of verification keys by key id. The key with
+// an empty id is used for tokens whose kid isn't in the set.
+type StaticKeys map[string]interface{}
+
+// KeySet holds the keys of a JWKS document by key id. Unlike StaticKeys
+// it has no fallback key: tokens must name a key of the set.
+type KeySet map[string]interface{}
+
+func (k KeySet) Key(kid string, alg string) (interface{}, error) {
+	if key, ok := k[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+}
+
+// NewHMACKeys returns the StaticKeys of a single HS256 secret.
+func NewHMACKeys(secret []byte) StaticKeys {
+	return StaticKeys{"": secret}
+}
+
+func (k StaticKeys) Key(kid string, alg string) (interface{}, error) {
+	if key, ok := k[kid]; ok {
+		return key, nil
+	}
+	if key, ok := k[""]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+}
+
+// LoadKeyFile reads verification keys from a JWKS document, as a KeySet,
+// or from PEM encoded public keys and certificates, as StaticKeys. PEM keys
+// have no id, so a file should hold a single one.
+func LoadKeyFile(path string) (KeySource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		return parseJWKS(data)
+	}
+
+	keys := StaticKeys{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys[""] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no public key found", path)
+	}
+	return keys, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func parseJWKS(data []byte) (KeySet, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := KeySet{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.key()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// key returns the public key or secret of k, nil for unsupported key types.
+func (k jwk) key() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point not on curve")
+		}
+		return pub, nil
+	case "oct":
+		return decode(k.K)
+	}
+	return nil, nil
+}
+
+// JWKSKeys fetches verification keys from a JWKS endpoint. Keys are
+// refreshed every RefreshInterval, and early when a token names an unknown
+// key id, at most once per MinRefreshInterval, so rotated keys are picked
+// up without restarts. The last fetched keys are kept while the endpoint fails.
+// Fetches run in the background: only callers whose key id isn't known yet
+// wait for them.
+type JWKSKeys struct {
+	URL                string
+	HTTPClient         *http.Client
+	RefreshInterval    time.Duration
+	MinRefreshInterval time.Duration
+
+	mu        sync.Mutex
+	keys      KeySet
+	fetchedAt time.Time
+	triedAt   time.Time
+	fetching  chan struct{}
+}
+
+func NewJWKSKeys(url string) *JWKSKeys {
+	return &JWKSKeys{
+		URL:                url,
+		HTTPClient:         &http.Client{Timeout: 10 * time.Second},
+		RefreshInterval:    time.Hour,
+		MinRefreshInterval: 30 * time.Second,
+	}
+}
+
+func (j *JWKSKeys) Key(kid string, alg string) (interface{}, error) {
+	j.mu.Lock()
+	now := time.Now()
+	_, known := j.keys[kid]
+	stale := j.keys == nil || now.Sub(j.fetchedAt) >= j.RefreshInterval
+	if (stale || !known) && j.fetching == nil && now.Sub(j.triedAt) >= j.MinRefreshInterval {
+		j.triedAt = now
+		j.fetching = make(chan struct{})
+		go j.refresh(j.fetching)
+	}
+	fetching := j.fetching
+	j.mu.Unlock()
+
+	if !known && fetching != nil {
+		<-fetching
+	}
+
+	j.mu.Lock()
+	keys := j.keys
+	j.mu.Unlock()
+	if keys == nil {
+		return nil, fmt.Errorf("%w %q: no keys fetched from %s", ErrUnknownKey, kid, j.URL)
+	}
+	return keys.Key(kid, alg)
+}
+
+// refresh fetches the keys and closes done.
+func (j *JWKSKeys) refresh(done chan struct{}) {
+	keys, err := j.fetch()
+	j.mu.Lock()
+	if err != nil {
+		logging.Warn("jwks refresh failed", "url", j.URL, "err", err)
+	} else {
+		j.keys = keys
+		j.fetchedAt = time.Now()
+	}
+	j.fetching = nil
+	j.mu.Unlock()
+	close(done)
+}
+
+func (j *JWKSKeys) fetch() (KeySet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", j.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := j.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", j.URL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
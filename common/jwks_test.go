@@ -0,0 +1,199 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func rsaJWK(kid string, pub *rsa.PublicKey) map[string]string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return map[string]string{
+		"kty": "RSA", "kid": kid, "use": "sig",
+		"n": enc(pub.N.Bytes()), "e": enc(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+func jwksDoc(keys ...map[string]string) []byte {
+	j, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return j
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	enc := base64.RawURLEncoding.EncodeToString
+
+	keys, err := parseJWKS(jwksDoc(
+		rsaJWK("rs", &rsaKey.PublicKey),
+		map[string]string{"kty": "EC", "kid": "es", "crv": "P-256", "x": enc(ecKey.X.Bytes()), "y": enc(ecKey.Y.Bytes())},
+		map[string]string{"kty": "oct", "kid": "hs", "k": enc([]byte("secret"))},
+		map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQ", "e": "AQAB"},
+		map[string]string{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": "AA"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, ok := keys["rs"].(*rsa.PublicKey); !ok || pub.N.Cmp(rsaKey.N) != 0 || pub.E != rsaKey.E {
+		t.Errorf("rs: got %v", keys["rs"])
+	}
+	if pub, ok := keys["es"].(*ecdsa.PublicKey); !ok || pub.X.Cmp(ecKey.X) != 0 || pub.Y.Cmp(ecKey.Y) != 0 {
+		t.Errorf("es: got %v", keys["es"])
+	}
+	if secret, ok := keys["hs"].([]byte); !ok || string(secret) != "secret" {
+		t.Errorf("hs: got %v", keys["hs"])
+	}
+	if len(keys) != 3 {
+		t.Errorf("got %d keys, want 3 without the encryption and unsupported keys", len(keys))
+	}
+
+	if _, err := parseJWKS(jwksDoc(map[string]string{"kty": "EC", "kid": "bad", "crv": "P-256", "x": "AQ", "y": "AQ"})); err == nil {
+		t.Error("point off the curve accepted")
+	}
+}
+
+func TestKeySetHasNoFallback(t *testing.T) {
+	keys, err := parseJWKS(jwksDoc(map[string]string{"kty": "oct", "kid": "", "k": "c2VjcmV0"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Key("other", "HS256"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v, want ErrUnknownKey", err)
+	}
+	if _, err := NewHMACKeys([]byte("secret")).Key("other", "HS256"); err != nil {
+		t.Errorf("HMAC keys: %v", err)
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	ioutil.WriteFile(path, jwksDoc(rsaJWK("rs", &rsaKey.PublicKey)), 0600)
+
+	keys, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Key("rs", "RS256"); err != nil {
+		t.Error(err)
+	}
+	if _, err := keys.Key("", "RS256"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("JWKS file fell back: %v", err)
+	}
+}
+
+// jwksServer serves the keys of docs[i] on the i-th request, repeating the
+// last one. Requests wait on release when it is set.
+type jwksServer struct {
+	mu       sync.Mutex
+	docs     [][]byte
+	requests int
+	release  chan struct{}
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	doc := s.docs[len(s.docs)-1]
+	if s.requests < len(s.docs) {
+		doc = s.docs[s.requests]
+	}
+	s.requests++
+	release := s.release
+	s.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+	w.Write(doc)
+}
+
+func TestJWKSKeysRotation(t *testing.T) {
+	old, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	js := &jwksServer{docs: [][]byte{
+		jwksDoc(rsaJWK("old", &old.PublicKey)),
+		jwksDoc(rsaJWK("old", &old.PublicKey), rsaJWK("new", &rotated.PublicKey)),
+	}}
+	srv := httptest.NewServer(js)
+	defer srv.Close()
+
+	keys := NewJWKSKeys(srv.URL)
+	keys.MinRefreshInterval = 0
+	if _, err := keys.Key("old", "RS256"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := keys.Key("new", "RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub := key.(*rsa.PublicKey); pub.N.Cmp(rotated.N) != 0 {
+		t.Error("got the wrong key")
+	}
+	if _, err := keys.Key("", "RS256"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("empty kid: got %v", err)
+	}
+}
+
+func TestJWKSKeysServeCachedWhileFetching(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	js := &jwksServer{docs: [][]byte{jwksDoc(rsaJWK("known", &key.PublicKey))}}
+	srv := httptest.NewServer(js)
+	defer srv.Close()
+
+	keys := NewJWKSKeys(srv.URL)
+	keys.MinRefreshInterval = 0
+	if _, err := keys.Key("known", "RS256"); err != nil {
+		t.Fatal(err)
+	}
+
+	js.mu.Lock()
+	js.release = make(chan struct{})
+	js.mu.Unlock()
+	unknown := make(chan error, 1)
+	go func() {
+		_, err := keys.Key("unknown", "RS256")
+		unknown <- err
+	}()
+
+	known := make(chan error, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, err := keys.Key("known", "RS256")
+		known <- err
+	}()
+	select {
+	case err := <-known:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("known key blocked by the fetch of an unknown one")
+	}
+
+	close(js.release)
+	if err := <-unknown; !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("unknown key: got %v", err)
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.requests != 2 {
+		t.Errorf("got %d fetches, want 2", js.requests)
+	}
+}
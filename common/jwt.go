@@ -0,0 +1,261 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// AccessTokenVerifier, when set, verifies access tokens locally in Guard
+// instead of calling users/guard.
+var AccessTokenVerifier *JWTVerifier
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// KeySource returns the key verifying tokens signed with kid and alg:
+// []byte for HS256, *rsa.PublicKey for RS256 and *ecdsa.PublicKey for ES256.
+type KeySource interface {
+	Key(kid string, alg string) (interface{}, error)
+}
+
+// Claims are the decoded claims of a verified token.
+type Claims map[string]interface{}
+
+// JWTVerifier verifies HS256, RS256 and ES256 signed access tokens.
+type JWTVerifier struct {
+	Keys KeySource
+	// Issuer and Audience are checked when set.
+	Issuer   string
+	Audience string
+	// Leeway allows for clock skew when checking exp and nbf.
+	Leeway time.Duration
+	// MapClaims builds the user from the claims, DefaultMapClaims when nil.
+	MapClaims func(claims Claims) (User, error)
+	// FallbackToRemote makes Guard call users/guard when a token can't be
+	// verified locally or its user lacks the restrictions.
+	FallbackToRemote bool
+}
+
+func NewJWTVerifier(keys KeySource) *JWTVerifier {
+	return &JWTVerifier{Keys: keys, Leeway: 30 * time.Second}
+}
+
+func tokenError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidToken, fmt.Sprintf(format, args...))
+}
+
+// Verify checks the signature and the registered claims of token.
+func (v *JWTVerifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, tokenError("malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, tokenError("header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, tokenError("signature: %v", err)
+	}
+	key, err := v.Keys.Key(header.Kid, header.Alg)
+	if err != nil {
+		return nil, tokenError("%v", err)
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, tokenError("claims: %v", err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifySignature(alg string, key interface{}, signed string, sig []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return tokenError("key type does not match %s", alg)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return tokenError("bad signature")
+		}
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return tokenError("key type does not match %s", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig); err != nil {
+			return tokenError("bad signature")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() {
+			return tokenError("key type does not match %s", alg)
+		}
+		if len(sig) != 64 {
+			return tokenError("bad signature")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return tokenError("bad signature")
+		}
+	default:
+		return tokenError("unsupported algorithm %q", alg)
+	}
+	return nil
+}
+
+func (v *JWTVerifier) checkClaims(claims Claims) error {
+	now := time.Now()
+	exp, ok := claims.time("exp")
+	if !ok {
+		return tokenError("no expiry")
+	}
+	if !now.Before(exp.Add(v.Leeway)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(v.Leeway).Before(nbf) {
+		return tokenError("not valid yet")
+	}
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return tokenError("issuer %q", claims.String("iss"))
+	}
+	if v.Audience != "" && !hasString(claims.Strings("aud"), v.Audience) {
+		return tokenError("audience does not match")
+	}
+	return nil
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(n), 0), true
+}
+
+// String returns a string claim, or an empty string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a string or string array claim.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// firstString returns the first non empty string claim of names.
+func (c Claims) firstString(names ...string) string {
+	for _, name := range names {
+		if s := c.String(name); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// DefaultMapClaims maps standard and users service claims into a User.
+func DefaultMapClaims(claims Claims) (User, error) {
+	user := User{
+		Id:           claims.firstString("_id", "id", "sub"),
+		Email:        claims.firstString("email"),
+		FirstName:    claims.firstString("firstName", "given_name"),
+		LastName:     claims.firstString("lastName", "family_name"),
+		Gender:       claims.firstString("gender"),
+		Picture:      claims.firstString("picture"),
+		Roles:        claims.Strings("roles"),
+		Capabilities: claims.Strings("capabilities"),
+	}
+	if b, ok := claims["emailConfirmation"].(bool); ok {
+		user.EmailConfirmation = b
+	} else if b, ok := claims["email_verified"].(bool); ok {
+		user.EmailConfirmation = b
+	}
+	if s := claims.firstString("birthday", "birthdate"); s != "" {
+		for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				user.Birthday = t
+				break
+			}
+		}
+	}
+	if user.Id == "" {
+		return User{}, tokenError("no subject")
+	}
+	return user, nil
+}
+
+// Credentials verifies the access token of h and returns the credentials of
+// its user, forbidden when the user lacks one of restrictions among its
+// capabilities or roles. The tenant claim, when present, is the Tenant.
+func (v *JWTVerifier) Credentials(h *HeaderParams, restrictions []string) (Credentials, error) {
+	claims, err := v.Verify(h.AccessToken)
+	if err != nil {
+		return Credentials{}, newGuardError(ErrUnauthenticated, err)
+	}
+	mapClaims := v.MapClaims
+	if mapClaims == nil {
+		mapClaims = DefaultMapClaims
+	}
+	user, err := mapClaims(claims)
+	if err != nil {
+		return Credentials{}, newGuardError(ErrUnauthenticated, err)
+	}
+	if h.UserId != "" && h.UserId != user.Id {
+		return Credentials{}, newGuardError(ErrUnauthenticated, errors.New("user id does not match token"))
+	}
+	tenant := claims.String("tenant")
+	if !hasRestrictions(user, restrictions) {
+		return Credentials{Authentication: true, User: user, Tenant: tenant}, newGuardError(ErrForbidden, nil)
+	}
+	return Credentials{Authentication: true, Authorization: true, User: user, Tenant: tenant}, nil
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func b64(v interface{}) string {
+	j, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(j)
+}
+
+// signToken returns a JWT of claims signed with key, a []byte HMAC secret,
+// an *rsa.PrivateKey or an *ecdsa.PrivateKey.
+func signToken(t *testing.T, alg string, kid string, key interface{}, claims Claims) string {
+	t.Helper()
+	signed := b64(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + b64(claims)
+	hash := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func validClaims() Claims {
+	return Claims{"sub": "u1", "exp": float64(time.Now().Add(time.Hour).Unix())}
+}
+
+func TestJWTVerifierAlgorithms(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	v := NewJWTVerifier(StaticKeys{"hs": secret, "rs": &rsaKey.PublicKey, "es": &ecKey.PublicKey})
+
+	for _, tc := range []struct {
+		alg, kid string
+		key      interface{}
+	}{
+		{"HS256", "hs", secret},
+		{"RS256", "rs", rsaKey},
+		{"ES256", "es", ecKey},
+	} {
+		claims, err := v.Verify(signToken(t, tc.alg, tc.kid, tc.key, validClaims()))
+		if err != nil {
+			t.Errorf("%s: %v", tc.alg, err)
+		} else if claims.String("sub") != "u1" {
+			t.Errorf("%s: got claims %v", tc.alg, claims)
+		}
+	}
+}
+
+func TestJWTVerifierRejects(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	v := NewJWTVerifier(StaticKeys{"hs": secret, "rs": &rsaKey.PublicKey})
+	v.Issuer = "auth"
+	v.Audience = "api"
+	v.Leeway = 0
+
+	claims := func(set map[string]interface{}, del ...string) Claims {
+		c := Claims{"iss": "auth", "aud": []interface{}{"api"}}
+		for k, val := range validClaims() {
+			c[k] = val
+		}
+		for k, val := range set {
+			c[k] = val
+		}
+		for _, k := range del {
+			delete(c, k)
+		}
+		return c
+	}
+	hour := float64(time.Hour / time.Second)
+	now := float64(time.Now().Unix())
+
+	if _, err := v.Verify(signToken(t, "HS256", "hs", secret, claims(nil))); err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	for name, tc := range map[string]struct {
+		token string
+		err   error
+	}{
+		"no exp":        {signToken(t, "HS256", "hs", secret, claims(nil, "exp")), ErrInvalidToken},
+		"expired":       {signToken(t, "HS256", "hs", secret, claims(map[string]interface{}{"exp": now - hour})), ErrTokenExpired},
+		"not yet valid": {signToken(t, "HS256", "hs", secret, claims(map[string]interface{}{"nbf": now + hour})), ErrInvalidToken},
+		"issuer":        {signToken(t, "HS256", "hs", secret, claims(map[string]interface{}{"iss": "other"})), ErrInvalidToken},
+		"audience":      {signToken(t, "HS256", "hs", secret, claims(map[string]interface{}{"aud": "other"})), ErrInvalidToken},
+		"bad signature": {signToken(t, "HS256", "hs", []byte("wrong"), claims(nil)), ErrInvalidToken},
+		"alg mismatch":  {signToken(t, "HS256", "rs", secret, claims(nil)), ErrInvalidToken},
+		"alg none":      {b64(map[string]string{"alg": "none"}) + "." + b64(claims(nil)) + ".", ErrInvalidToken},
+		"malformed":     {"a.b", ErrInvalidToken},
+	} {
+		if _, err := v.Verify(tc.token); !errors.Is(err, tc.err) {
+			t.Errorf("%s: got %v, want %v", name, err, tc.err)
+		}
+	}
+}
+
+func TestJWTVerifierCredentials(t *testing.T) {
+	secret := []byte("secret")
+	v := NewJWTVerifier(NewHMACKeys(secret))
+	c := validClaims()
+	c["roles"] = []interface{}{"admin"}
+	token := signToken(t, "HS256", "", secret, c)
+
+	creds, err := v.Credentials(&HeaderParams{AccessToken: token}, []string{"admin"})
+	if err != nil || !creds.Authorization || creds.User.Id != "u1" {
+		t.Fatalf("got %+v, %v", creds, err)
+	}
+	if _, err := v.Credentials(&HeaderParams{AccessToken: token}, []string{"owner"}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("missing restriction: got %v", err)
+	}
+	if _, err := v.Credentials(&HeaderParams{AccessToken: token, UserId: "u2"}, nil); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("other user id: got %v", err)
+	}
+}
@@ -0,0 +1,506 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/logging"
+	"github.com/ahmadIte99/hamdan_common/tracing"
+)
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the Hijacker and deadlines of
+// the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Recover turns panics of the next handlers into JSON 500 responses and
+// prints their stack.
+func Recover() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := &statusWriter{ResponseWriter: w}
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				logging.FromContext(r.Context()).Error("panic serving request", "method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+				if sw.status == 0 {
+					WriteError(sw, r, NewAPIError(http.StatusInternalServerError, "internal", "internal server error"))
+				}
+			}()
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
+
+// RequestLogger stores in the request context a logger carrying the request
+// id and tenant of the request, see logging.FromContext. GuardMiddleware
+// adds the user id to it. It belongs after RequestIdMiddleware.
+func RequestLogger() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var kv []interface{}
+			if id := r.Header.Get(tracing.RequestIdHeader); id != "" {
+				kv = append(kv, "requestId", id)
+			}
+			if tenant := requestTenant(r); tenant != "" {
+				kv = append(kv, "tenant", tenant)
+			}
+			l := logging.FromContext(r.Context()).With(kv...)
+			next.ServeHTTP(w, r.WithContext(logging.WithContext(r.Context(), l)))
+		})
+	}
+}
+
+// AccessLogEntry is one line written by AccessLog.
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"durationMs"`
+	RequestId string    `json:"requestId,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// AccessLog writes a JSON AccessLogEntry line per request to out, or logs
+// it at info level with the default logger when out is nil.
+func AccessLog(out io.Writer) Middleware {
+	var mu sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			defer func() {
+				e := AccessLogEntry{
+					Time:      start,
+					Method:    r.Method,
+					Path:      r.URL.Path,
+					Status:    sw.status,
+					Bytes:     sw.written,
+					Duration:  float64(time.Since(start).Microseconds()) / 1000,
+					RequestId: r.Header.Get(tracing.RequestIdHeader),
+					Remote:    r.RemoteAddr,
+					UserAgent: r.UserAgent(),
+				}
+				if e.Status == 0 {
+					e.Status = http.StatusOK
+				}
+				if t, ok := tracing.FromContext(r.Context()); ok && t.RequestId != "" {
+					e.RequestId = t.RequestId
+				}
+				if out == nil {
+					logging.Info("request", "method", e.Method, "path", e.Path, "status", e.Status, "bytes", e.Bytes,
+						"durationMs", e.Duration, "requestId", e.RequestId, "remote", e.Remote, "userAgent", e.UserAgent)
+					return
+				}
+				line, _ := json.Marshal(e)
+				mu.Lock()
+				out.Write(append(line, '\n'))
+				mu.Unlock()
+			}()
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
+
+// Timeout cancels the request context after d and answers 503 with
+// WriteError when the next handlers haven't responded by then. Their
+// response is buffered until they return.
+func Timeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			r = r.WithContext(ctx)
+
+			tw := &timeoutWriter{header: http.Header{}}
+			done := make(chan struct{})
+			panicked := make(chan interface{}, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+				}()
+				next.ServeHTTP(tw, r)
+				close(done)
+			}()
+
+			select {
+			case p := <-panicked:
+				panic(p)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				dst := w.Header()
+				for k, v := range tw.header {
+					dst[k] = v
+				}
+				if tw.status == 0 {
+					tw.status = http.StatusOK
+				}
+				w.WriteHeader(tw.status)
+				w.Write(tw.body.Bytes())
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				WriteError(w, r, NewAPIError(http.StatusServiceUnavailable, "timeout", "request timed out"))
+			}
+		})
+	}
+}
+
+// timeoutWriter buffers the response of the handlers behind Timeout.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.status == 0 && !tw.timedOut {
+		tw.status = status
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.body.Write(b)
+}
+
+// MaxBodySize limits request bodies to n bytes. Larger declared bodies are
+// rejected with 413, and reading past n fails in the next handlers.
+func MaxBodySize(n int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				WriteError(w, r, NewAPIError(http.StatusRequestEntityTooLarge, "too_large", "request body too large"))
+				return
+			}
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, n)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// gzipWriter compresses the response unless the handler set its own
+// Content-Encoding or the status has no body. The header is sent with the
+// first write, so the content type is sniffed from the uncompressed body.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	status      int
+	wroteHeader bool
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipWriter) writeHeader(sniff []byte) {
+	w.wroteHeader = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") == "" && w.status != http.StatusNoContent && w.status != http.StatusNotModified {
+		if h.Get("Content-Type") == "" && sniff != nil {
+			h.Set("Content-Type", http.DetectContentType(sniff))
+		}
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.writeHeader(b)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+func (w *gzipWriter) Flush() {
+	if !w.wroteHeader {
+		w.writeHeader(nil)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the Hijacker and deadlines of
+// the underlying writer.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipWriter) close() {
+	if !w.wroteHeader {
+		// nothing written, send the status without compressing an empty body
+		w.wroteHeader = true
+		if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+		return
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
+
+// Gzip compresses responses of clients accepting gzip.
+func Gzip() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if r.Method == "HEAD" || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			gw := &gzipWriter{ResponseWriter: w}
+			defer gw.close()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
+
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			if q := strings.TrimSpace(f); q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// CORSOptions configure CORS. Origins may contain a leading wildcard
+// subdomain such as "https://*.example.com". The origin "*" allows any
+// origin, answering with a literal * and never with credentials.
+type CORSOptions struct {
+	AllowedOrigins []string
+	// TenantOrigins are the origins of each tenant, allowed in addition to
+	// AllowedOrigins. When Tenant is nil the origin of any tenant is allowed.
+	TenantOrigins map[string][]string
+	// Tenant, when set, returns the tenant of a request, e.g. from its
+	// path, whose origins are allowed; preflight requests carry no
+	// credentials or custom headers to tell it from.
+	Tenant           func(r *http.Request) string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// CORS answers preflight requests and adds the CORS headers to responses
+// of allowed origins.
+func CORS(opts CORSOptions) Middleware {
+	if len(opts.AllowedMethods) == 0 {
+		opts.AllowedMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	if len(opts.AllowedHeaders) == 0 {
+		opts.AllowedHeaders = []string{"Content-Type", "Authorization"}
+		for _, f := range headerFields {
+			opts.AllowedHeaders = append(opts.AllowedHeaders, f.name)
+		}
+	}
+	anyOrigin := hasString(opts.AllowedOrigins, "*")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+			switch {
+			case opts.allows(origin, r):
+				h.Set("Access-Control-Allow-Origin", origin)
+				if opts.AllowCredentials {
+					h.Set("Access-Control-Allow-Credentials", "true")
+				}
+			case anyOrigin:
+				h.Set("Access-Control-Allow-Origin", "*")
+			default:
+				if preflight {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !preflight {
+				if len(opts.ExposedHeaders) > 0 {
+					h.Set("Access-Control-Expose-Headers", strings.Join(opts.ExposedHeaders, ", "))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", strings.Join(opts.AllowedMethods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(opts.AllowedHeaders, ", "))
+			if opts.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// allows reports whether origin is one of the allowed or tenant origins,
+// not counting "*".
+func (o *CORSOptions) allows(origin string, r *http.Request) bool {
+	if matchOrigins(o.AllowedOrigins, origin) {
+		return true
+	}
+	if o.Tenant != nil {
+		tenant := o.Tenant(r)
+		return tenant != "" && matchOrigins(o.TenantOrigins[tenant], origin)
+	}
+	for _, origins := range o.TenantOrigins {
+		if matchOrigins(origins, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOrigins(allowed []string, origin string) bool {
+	for _, a := range allowed {
+		if strings.EqualFold(a, origin) {
+			return true
+		}
+		if i := strings.Index(a, "://*."); i >= 0 {
+			scheme, suffix := a[:i+3], a[i+4:]
+			if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, suffix) && len(origin) > len(scheme)+len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DefaultSecurityHeaders are set by SecurityHeaders, suited for JSON APIs.
+var DefaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options":    "nosniff",
+	"X-Frame-Options":           "DENY",
+	"Referrer-Policy":           "no-referrer",
+	"Content-Security-Policy":   "default-src 'none'; frame-ancestors 'none'",
+	"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+}
+
+// SecurityHeaders sets DefaultSecurityHeaders on every response, with
+// overrides applied; an empty override drops the header.
+func SecurityHeaders(overrides map[string]string) Middleware {
+	headers := map[string]string{}
+	for k, v := range DefaultSecurityHeaders {
+		headers[k] = v
+	}
+	for k, v := range overrides {
+		if v == "" {
+			delete(headers, k)
+			continue
+		}
+		headers[k] = v
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			for k, v := range headers {
+				h.Set(k, v)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
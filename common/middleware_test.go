@@ -0,0 +1,180 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchOrigins(t *testing.T) {
+	allowed := []string{"https://app.example.com", "https://*.example.org"}
+	for origin, want := range map[string]bool{
+		"https://app.example.com":   true,
+		"https://APP.example.com":   true,
+		"http://app.example.com":    false,
+		"https://a.example.org":     true,
+		"https://a.b.example.org":   true,
+		"https://example.org":       false,
+		"https://.example.org":      false,
+		"https://evilexample.org":   false,
+		"http://a.example.org":      false,
+		"https://a.example.org.com": false,
+	} {
+		if got := matchOrigins(allowed, origin); got != want {
+			t.Errorf("%s: got %v, want %v", origin, got, want)
+		}
+	}
+	if matchOrigins([]string{"*"}, "https://any.com") {
+		t.Error(`"*" matched as an origin`)
+	}
+}
+
+func corsRequest(t *testing.T, opts CORSOptions, method string, path string, origin string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Origin", origin)
+	if method == "OPTIONS" {
+		r.Header.Set("Access-Control-Request-Method", "POST")
+	}
+	w := httptest.NewRecorder()
+	CORS(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+	return w
+}
+
+func TestCORS(t *testing.T) {
+	opts := CORSOptions{
+		AllowedOrigins:   []string{"https://app.example.com", "*"},
+		AllowCredentials: true,
+	}
+
+	w := corsRequest(t, opts, "OPTIONS", "/", "https://app.example.com")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("listed origin: got %d %v", w.Code, w.Header())
+	}
+
+	w = corsRequest(t, opts, "GET", "/", "https://other.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf(`"*" origin: got %v`, w.Header())
+	}
+
+	opts.AllowedOrigins = opts.AllowedOrigins[:1]
+	w = corsRequest(t, opts, "OPTIONS", "/", "https://other.com")
+	if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("unlisted origin: got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestCORSTenantOrigins(t *testing.T) {
+	opts := CORSOptions{TenantOrigins: map[string][]string{
+		"acme":  {"https://acme.com"},
+		"globx": {"https://globx.com"},
+	}}
+	allowed := func(path string, origin string) bool {
+		return corsRequest(t, opts, "OPTIONS", path, origin).Code == http.StatusNoContent
+	}
+
+	if !allowed("/", "https://acme.com") || !allowed("/", "https://globx.com") || allowed("/", "https://other.com") {
+		t.Error("tenant origins without Tenant")
+	}
+
+	opts.Tenant = func(r *http.Request) string {
+		return strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")[0]
+	}
+	if !allowed("/acme/posts", "https://acme.com") || allowed("/acme/posts", "https://globx.com") || allowed("/posts", "https://acme.com") {
+		t.Error("tenant origins with Tenant")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	handler := Timeout(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			w.Write([]byte("late"))
+			return
+		}
+		w.Header().Set("X-Done", "1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("ok"))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/fast", nil))
+	if w.Code != http.StatusCreated || w.Body.String() != "ok" || w.Header().Get("X-Done") != "1" {
+		t.Errorf("fast: got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+
+	r := httptest.NewRequest("GET", "/slow", nil)
+	r.Header.Set("x-request-id", "req-1")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("slow: %v in %q", err, w.Body.String())
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Content-Type") != "application/json" ||
+		body.Error.Code != "timeout" || body.Error.RequestId != "req-1" {
+		t.Errorf("slow: got %d %v %+v", w.Code, w.Header(), body)
+	}
+
+	PlainTextErrors = true
+	defer func() { PlainTextErrors = false }()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+	if w.Code != http.StatusServiceUnavailable || strings.TrimSpace(w.Body.String()) != "request timed out" {
+		t.Errorf("plain text: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// hijack unwraps w like http.ResponseController until it finds a Hijacker.
+func hijack(w http.ResponseWriter) (net.Conn, error) {
+	for {
+		if h, ok := w.(http.Hijacker); ok {
+			conn, _, err := h.Hijack()
+			return conn, err
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil, http.ErrNotSupported
+		}
+		w = u.Unwrap()
+	}
+}
+
+func TestMiddlewareWritersUnwrap(t *testing.T) {
+	handler := AccessLog(ioutil.Discard)(Gzip()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := hijack(w)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked"))
+	})))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "hijacked" || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("got %q %v", body, resp.Header)
+	}
+}
@@ -0,0 +1,160 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// methodHasBody reports whether requests with method carry a body.
+// Data of other methods is sent as query parameters.
+func methodHasBody(method string) bool {
+	switch strings.ToUpper(method) {
+	case "POST", "PUT", "PATCH":
+		return true
+	}
+	return false
+}
+
+// encodeQuery adds params to q. Slices and arrays add one value per element,
+// time.Time is formatted as RFC3339 and nil values are skipped.
+func encodeQuery(q url.Values, params map[string]interface{}) error {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := params[k]
+		if v == nil {
+			continue
+		}
+		rv := reflect.ValueOf(v)
+		if (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) && rv.Type().Elem().Kind() != reflect.Uint8 {
+			for i := 0; i < rv.Len(); i++ {
+				s, err := queryValue(rv.Index(i).Interface())
+				if err != nil {
+					return fmt.Errorf("query %s: %v", k, err)
+				}
+				q.Add(k, s)
+			}
+			continue
+		}
+		s, err := queryValue(v)
+		if err != nil {
+			return fmt.Errorf("query %s: %v", k, err)
+		}
+		q.Add(k, s)
+	}
+	return nil
+}
+
+func queryValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+	case fmt.Stringer:
+		return v.String(), nil
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(j), nil
+}
+
+// preparedRequest is the path, query and body of a RequestParams, built
+// once and reused when the call is retried.
+type preparedRequest struct {
+	path        string
+	body        []byte
+	stream      io.Reader
+	contentType string
+	// serviceToken is attached when the call has no x-service-token
+	serviceToken string
+}
+
+func prepareRequest(reqOpt *RequestParams) (*preparedRequest, error) {
+	p := &preparedRequest{path: reqOpt.Path}
+
+	q := url.Values{}
+	if err := encodeQuery(q, reqOpt.Query); err != nil {
+		return nil, err
+	}
+
+	hasBody := methodHasBody(reqOpt.Method)
+	switch {
+	case reqOpt.Body != nil:
+		p.stream = reqOpt.Body
+		p.contentType = reqOpt.ContentType
+	case reqOpt.RawBody != nil:
+		p.body = reqOpt.RawBody
+		p.contentType = reqOpt.ContentType
+	case hasBody:
+		j, err := json.Marshal(reqOpt.Data)
+		if err != nil {
+			return nil, err
+		}
+		p.body = j
+		p.contentType = "application/json"
+	default:
+		if err := encodeQuery(q, reqOpt.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(q) > 0 {
+		sep := "?"
+		if strings.Contains(p.path, "?") {
+			sep = "&"
+		}
+		p.path += sep + q.Encode()
+	}
+	return p, nil
+}
+
+// reader returns the request body, nil for bodyless requests.
+func (p *preparedRequest) reader() io.Reader {
+	if p.stream != nil {
+		return p.stream
+	}
+	if p.body != nil {
+		return bytes.NewReader(p.body)
+	}
+	return nil
+}
+
+// retryable reports whether the body can be sent again.
+func (p *preparedRequest) retryable() bool {
+	return p.stream == nil
+}
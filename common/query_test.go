@@ -0,0 +1,136 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stringer string
+
+func (s stringer) String() string {
+	return "s:" + string(s)
+}
+
+func TestEncodeQuery(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("", 2*3600))
+	q := url.Values{}
+	err := encodeQuery(q, map[string]interface{}{
+		"ids":    []int{1, 2, 3},
+		"tags":   [2]string{"a", "b"},
+		"at":     at,
+		"ok":     true,
+		"ratio":  0.5,
+		"name":   "x y",
+		"raw":    []byte("bytes"),
+		"kind":   stringer("k"),
+		"filter": map[string]int{"n": 1},
+		"nil":    nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := url.Values{
+		"ids":    {"1", "2", "3"},
+		"tags":   {"a", "b"},
+		"at":     {"2024-03-01T12:30:00+02:00"},
+		"ok":     {"true"},
+		"ratio":  {"0.5"},
+		"name":   {"x y"},
+		"raw":    {"bytes"},
+		"kind":   {"s:k"},
+		"filter": {`{"n":1}`},
+	}
+	if q.Encode() != want.Encode() {
+		t.Fatalf("got %s\nwant %s", q.Encode(), want.Encode())
+	}
+}
+
+func TestEncodeQueryError(t *testing.T) {
+	err := encodeQuery(url.Values{}, map[string]interface{}{"bad": []interface{}{func() {}}})
+	if err == nil || !strings.Contains(err.Error(), "query bad") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestPrepareRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		req         RequestParams
+		path        string
+		body        string
+		contentType string
+	}{
+		{
+			name: "GET data goes to the query",
+			req:  RequestParams{Method: "GET", Path: "users", Data: map[string]interface{}{"id": []string{"a", "b"}}},
+			path: "users?id=a&id=b",
+		},
+		{
+			name: "query is added to a path query",
+			req:  RequestParams{Method: "delete", Path: "users?force=1", Query: map[string]interface{}{"id": 7}},
+			path: "users?force=1&id=7",
+		},
+		{
+			name:        "POST data is a JSON body",
+			req:         RequestParams{Method: "POST", Path: "users", Data: map[string]interface{}{"n": 1}, Query: map[string]interface{}{"v": 2}},
+			path:        "users?v=2",
+			body:        `{"n":1}`,
+			contentType: "application/json",
+		},
+		{
+			name:        "PUT data is a JSON body",
+			req:         RequestParams{Method: "PUT", Path: "users/1", Data: map[string]interface{}{"n": 1}},
+			path:        "users/1",
+			body:        `{"n":1}`,
+			contentType: "application/json",
+		},
+		{
+			name:        "PATCH data is a JSON body",
+			req:         RequestParams{Method: "patch", Path: "users/1", Data: map[string]interface{}{"n": 1}},
+			path:        "users/1",
+			body:        `{"n":1}`,
+			contentType: "application/json",
+		},
+		{
+			name: "HEAD data goes to the query",
+			req:  RequestParams{Method: "HEAD", Path: "users", Data: map[string]interface{}{"n": 1}},
+			path: "users?n=1",
+		},
+		{
+			name:        "RawBody replaces the data",
+			req:         RequestParams{Method: "POST", Path: "files", RawBody: []byte("a,b"), ContentType: "text/csv", Data: map[string]interface{}{"n": 1}},
+			path:        "files",
+			body:        "a,b",
+			contentType: "text/csv",
+		},
+		{
+			name:        "Body replaces the data",
+			req:         RequestParams{Method: "PUT", Path: "files", Body: strings.NewReader("<a/>"), ContentType: "application/xml"},
+			path:        "files",
+			body:        "<a/>",
+			contentType: "application/xml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := prepareRequest(&tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body string
+			if r := p.reader(); r != nil {
+				b, _ := ioutil.ReadAll(r)
+				body = string(b)
+			}
+			if p.path != tt.path || body != tt.body || p.contentType != tt.contentType {
+				t.Fatalf("got %q, %q, %q, want %q, %q, %q", p.path, body, p.contentType, tt.path, tt.body, tt.contentType)
+			}
+			if p.retryable() != (tt.req.Body == nil) {
+				t.Errorf("retryable: got %v", p.retryable())
+			}
+		})
+	}
+}
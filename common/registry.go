@@ -0,0 +1,303 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ErrUnknownService = errors.New("unknown service")
+
+// Service is a registry entry. URL may hold several comma separated base
+// urls, which are added to URLs. When Env is set and the environment
+// variable is not empty it takes precedence, also as a comma separated list.
+type Service struct {
+	Name     string   `json:"name" yaml:"name"`
+	URL      string   `json:"url" yaml:"url"`
+	URLs     []string `json:"urls,omitempty" yaml:"urls,omitempty"`
+	Env      string   `json:"env,omitempty" yaml:"env,omitempty"`
+	Strategy Strategy `json:"strategy,omitempty" yaml:"strategy,omitempty"`
+}
+
+func (s Service) urls() []string {
+	if s.Env != "" {
+		if urls := splitURLs(os.Getenv(s.Env)); len(urls) > 0 {
+			return urls
+		}
+	}
+	urls := splitURLs(s.URL)
+	for _, u := range s.URLs {
+		urls = append(urls, splitURLs(u)...)
+	}
+	return urls
+}
+
+// ServiceRegistry resolves service names to base urls, balancing between
+// the instances of services with several urls.
+type ServiceRegistry struct {
+	mu        sync.RWMutex
+	services  map[string]Service
+	balancers map[string]*balancer
+}
+
+func NewServiceRegistry() *ServiceRegistry {
+	return &ServiceRegistry{services: map[string]Service{}, balancers: map[string]*balancer{}}
+}
+
+// DefaultServiceRegistry is used by CallService and GetServiceUrl.
+var DefaultServiceRegistry = newDefaultServiceRegistry()
+
+func newDefaultServiceRegistry() *ServiceRegistry {
+	r := NewServiceRegistry()
+	defaults := []struct {
+		name string
+		env  string
+		port string
+	}{
+		{"manager", "MANAGER_URL", "3030"},
+		{"options", "OPTIONS_URL", "3200"},
+		{"users", "USERS_URL", "3201"},
+		{"email", "EMAIL_URL", "3202"},
+		{"elearning", "ELEARNING_URL", "3203"},
+		{"files", "FILES_URL", "3204"},
+		{"serviceAuth", "SERVICE_AUTH_URL", "3209"},
+		{"notifications", "NOTIFICATIONS_URL", "3205"},
+		{"contact", "CONTACT_URL", "3206"},
+		{"cms", "CMS_URL", "3207"},
+		{"ticketing", "TICKETING_URL", "3210"},
+		{"types", "TYPES_URL", "3212"},
+		{"survey", "SURVEY_URL", "3213"},
+		{"paymentSmartDubaiHelper", "SMART_DUBAI_HELPER_PROXY_URL", "9735"},
+		{"payment", "PAYMENT_URL", "3214"},
+		{"newsletter", "NEWSLETTER_URL", "3215"},
+		{"imageBuilder", "IMAGE_BUILDER_URL", "3216"},
+		{"tahkeem", "TAHKEEM_URL", "3217"},
+		{"audit", "AUDIT_URL", "3218"},
+		{"backup", "BACKUP_URL", "3223"},
+	}
+	for _, d := range defaults {
+		r.RegisterService(Service{Name: d.name, URL: "http://localhost:" + d.port, Env: d.env})
+	}
+	return r
+}
+
+// Register adds or replaces a service with a fixed url.
+func (r *ServiceRegistry) Register(name string, url string) {
+	r.RegisterService(Service{Name: name, URL: url})
+}
+
+// RegisterService adds or replaces a service.
+func (r *ServiceRegistry) RegisterService(s Service) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.services[s.Name] = s
+	delete(r.balancers, s.Name)
+}
+
+// Unregister removes a service.
+func (r *ServiceRegistry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.services, name)
+	delete(r.balancers, name)
+}
+
+// Service returns the registry entry of a service.
+func (r *ServiceRegistry) Service(name string) (Service, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.services[name]
+	return s, ok
+}
+
+// Lookup returns a base url of a service or an error wrapping
+// ErrUnknownService.
+func (r *ServiceRegistry) Lookup(name string) (string, error) {
+	i, err := r.Pick(name)
+	if err != nil {
+		return "", err
+	}
+	i.release()
+	return i.URL, nil
+}
+
+// Pick returns an instance of a service other than exclude, using the
+// service strategy. Done must be called on the instance after the call.
+func (r *ServiceRegistry) Pick(name string, exclude ...*Instance) (*Instance, error) {
+	b, err := r.balancer(name)
+	if err != nil {
+		return nil, err
+	}
+	excluded := map[*Instance]bool{}
+	for _, i := range exclude {
+		excluded[i] = true
+	}
+	i := b.pick(excluded)
+	if i == nil {
+		return nil, fmt.Errorf("service %q has no other instance", name)
+	}
+	return i, nil
+}
+
+// Instances returns the number of instances of a service.
+func (r *ServiceRegistry) Instances(name string) (int, error) {
+	b, err := r.balancer(name)
+	if err != nil {
+		return 0, err
+	}
+	return len(b.instances), nil
+}
+
+func (r *ServiceRegistry) balancer(name string) (*balancer, error) {
+	r.mu.RLock()
+	s, ok := r.services[name]
+	b := r.balancers[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownService, name)
+	}
+	urls := s.urls()
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("service %q has no url", name)
+	}
+	if b != nil && b.urls == strings.Join(urls, ",") {
+		return b, nil
+	}
+
+	// first use, or the env changed since the balancer was built
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b = r.balancers[name]; b != nil && b.urls == strings.Join(urls, ",") {
+		return b, nil
+	}
+	b = newBalancer(urls, s.Strategy)
+	r.balancers[name] = b
+	return b, nil
+}
+
+// Services returns the registered service names, sorted.
+func (r *ServiceRegistry) Services() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.services))
+	for name := range r.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadFile registers the services in a JSON or YAML file, picked by the
+// file extension. The file maps service names to either a url or a Service
+// object, or lists Service objects:
+//
+//	{"users": "http://users:3201", "files": {"urls": ["http://files-1:3204", "http://files-2:3204"], "strategy": "leastInFlight"}}
+//	[{"name": "users", "url": "http://users:3201"}]
+func (r *ServiceRegistry) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	unmarshal := json.Unmarshal
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	}
+
+	var services []Service
+	if err := unmarshal(data, &services); err != nil {
+		var byName map[string]serviceEntry
+		if err := unmarshal(data, &byName); err != nil {
+			return fmt.Errorf("load services %s: %v", path, err)
+		}
+		services = services[:0]
+		for name, e := range byName {
+			s := Service(e)
+			s.Name = name
+			services = append(services, s)
+		}
+	}
+	for _, s := range services {
+		if s.Name == "" {
+			return fmt.Errorf("load services %s: service without name", path)
+		}
+		r.RegisterService(s)
+	}
+	return nil
+}
+
+// serviceEntry is a LoadFile entry, either a url or a Service object.
+type serviceEntry Service
+
+func (e *serviceEntry) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*e = serviceEntry{URL: url}
+		return nil
+	}
+	var s Service
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*e = serviceEntry(s)
+	return nil
+}
+
+func (e *serviceEntry) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*e = serviceEntry{URL: n.Value}
+		return nil
+	}
+	var s Service
+	if err := n.Decode(&s); err != nil {
+		return err
+	}
+	*e = serviceEntry(s)
+	return nil
+}
+
+// LoadEnv registers services from environment variables named
+// SERVICE_<NAME>_URL, e.g. SERVICE_USERS_URL=http://users-1:3201,http://users-2:3201
+// registers "users" with two instances. Names match registered services ignoring case and underscores,
+// other names are registered lower cased.
+func (r *ServiceRegistry) LoadEnv() {
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			continue
+		}
+		// the bare SERVICE_URL names no service
+		if len(parts[0]) <= len("SERVICE__URL") ||
+			!strings.HasPrefix(parts[0], "SERVICE_") || !strings.HasSuffix(parts[0], "_URL") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(parts[0], "SERVICE_"), "_URL")
+		if name == "AUTH" {
+			// SERVICE_AUTH_URL is the serviceAuth default
+			continue
+		}
+		r.Register(r.envName(name), parts[1])
+	}
+}
+
+// envName maps an environment style name such as IMAGE_BUILDER to a
+// registered service name, falling back to lower case.
+func (r *ServiceRegistry) envName(name string) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.ReplaceAll(s, "_", ""))
+	}
+	for _, existing := range r.Services() {
+		if normalize(existing) == normalize(name) {
+			return existing
+		}
+	}
+	return strings.ToLower(name)
+}
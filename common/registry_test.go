@@ -0,0 +1,95 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTemp(t *testing.T, name string, data string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	files := map[string]string{
+		"services.json": `{"users": "http://users:3201",
+			"files": {"urls": ["http://files-1:3204", "http://files-2:3204"], "strategy": "leastInFlight", "env": "FILES_X"}}`,
+		"services.yaml": `
+users: http://users:3201
+files:
+  urls: [http://files-1:3204, http://files-2:3204]
+  strategy: leastInFlight
+  env: FILES_X
+`,
+		"list.json": `[{"name": "users", "url": "http://users:3201"},
+			{"name": "files", "urls": ["http://files-1:3204", "http://files-2:3204"], "strategy": "leastInFlight", "env": "FILES_X"}]`,
+	}
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			r := NewServiceRegistry()
+			if err := r.LoadFile(writeTemp(t, name, data)); err != nil {
+				t.Fatal(err)
+			}
+			if s, _ := r.Service("users"); s.URL != "http://users:3201" {
+				t.Errorf("users: got %+v", s)
+			}
+			want := Service{
+				Name:     "files",
+				URLs:     []string{"http://files-1:3204", "http://files-2:3204"},
+				Env:      "FILES_X",
+				Strategy: LeastInFlight,
+			}
+			if s, _ := r.Service("files"); !reflect.DeepEqual(s, want) {
+				t.Errorf("files: got %+v, want %+v", s, want)
+			}
+		})
+	}
+}
+
+func TestLoadFileInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"bad.json":    `{"users": 3}`,
+		"noname.json": `[{"url": "http://users:3201"}]`,
+		"broken.yaml": "users: [",
+	} {
+		if err := NewServiceRegistry().LoadFile(writeTemp(t, name, data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	for k, v := range map[string]string{
+		"SERVICE_URL":               "http://nowhere",
+		"SERVICE_AUTH_URL":          "http://auth",
+		"SERVICE_IMAGE_BUILDER_URL": "http://image-builder",
+		"SERVICE_BILLING_URL":       "http://billing",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	r := NewServiceRegistry()
+	r.Register("imageBuilder", "http://localhost:3216")
+	r.LoadEnv()
+
+	want := []string{"billing", "imageBuilder"}
+	if got := r.Services(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if url, _ := r.Lookup("imageBuilder"); url != "http://image-builder" {
+		t.Errorf("imageBuilder: got %q", url)
+	}
+}
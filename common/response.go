@@ -0,0 +1,83 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ahmadIte99/hamdan_common/logging"
+	"github.com/ahmadIte99/hamdan_common/tracing"
+)
+
+// PlainTextErrors makes WriteError answer with the message as plain text,
+// like http.Error, instead of the JSON envelope.
+var PlainTextErrors = false
+
+// APIError is the error envelope written by WriteError:
+//
+//	{"error": {"code": "forbidden", "message": "...", "details": ..., "requestId": "..."}}
+type APIError struct {
+	Status    int         `json:"-"`
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestId string      `json:"requestId,omitempty"`
+}
+
+func NewAPIError(status int, code string, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+// WithDetails returns a copy of e carrying details.
+func (e *APIError) WithDetails(details interface{}) *APIError {
+	c := *e
+	c.Details = details
+	return &c
+}
+
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// WriteJSON writes v as a JSON response with status.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Error("writing JSON response failed", "err", err)
+	}
+}
+
+// WriteError writes e in the error envelope, with the request id of r
+// when e has none. r may be nil.
+func WriteError(w http.ResponseWriter, r *http.Request, e *APIError) {
+	status := e.Status
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	if PlainTextErrors {
+		http.Error(w, e.Message, status)
+		return
+	}
+	if e.RequestId == "" {
+		c := *e
+		c.RequestId = requestId(w, r)
+		e = &c
+	}
+	WriteJSON(w, status, struct {
+		Error *APIError `json:"error"`
+	}{e})
+}
+
+// requestId returns the request id of r, from its context or headers, or
+// the one RequestIdMiddleware set on the response.
+func requestId(w http.ResponseWriter, r *http.Request) string {
+	if r != nil {
+		if t, ok := tracing.FromContext(r.Context()); ok && t.RequestId != "" {
+			return t.RequestId
+		}
+		if id := r.Header.Get(tracing.RequestIdHeader); id != "" {
+			return id
+		}
+	}
+	return w.Header().Get(tracing.RequestIdHeader)
+}
@@ -0,0 +1,151 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/interval"
+)
+
+// IdempotencyKeyHeader carries RequestParams.IdempotencyKey. Setting a key
+// allows retrying non idempotent methods such as POST.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RetryPolicy configures retries of failed service calls.
+type RetryPolicy struct {
+	// MaxAttempts includes the first call, -1 for no limit.
+	MaxAttempts int
+	Backoff     interval.Backoff
+	// RetryableStatus lists the response statuses that are retried.
+	// Connection errors are always retried.
+	RetryableStatus []int
+	// MaxRetryAfter caps the wait requested by a Retry-After header,
+	// zero means no cap.
+	MaxRetryAfter time.Duration
+}
+
+// DefaultRetryPolicy retries twice with exponential backoff on 429, 502,
+// 503 and 504 responses.
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts:     3,
+	Backoff:         interval.Exponential(100*time.Millisecond, 2*time.Second),
+	RetryableStatus: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	MaxRetryAfter:   10 * time.Second,
+}
+
+func (p *RetryPolicy) retryable(status int) bool {
+	for _, s := range p.RetryableStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// canRetry reports whether reqOpt may be sent more than once.
+func canRetry(reqOpt *RequestParams, prepared *preparedRequest) bool {
+	return prepared.retryable() && (isIdempotent(reqOpt.Method) || reqOpt.IdempotencyKey != "")
+}
+
+// retryStatusError asks interval.DoBackoff to retry a response status,
+// after the Retry-After delay when the response had one.
+type retryStatusError struct {
+	status int
+	delay  time.Duration
+}
+
+func (e *retryStatusError) Error() string {
+	return fmt.Sprintf("retryable status %d", e.status)
+}
+
+// retryAfterError wraps a retryStatusError with a Retry-After delay so
+// DoBackoff uses it instead of the backoff.
+type retryAfterError struct {
+	*retryStatusError
+}
+
+func (e retryAfterError) Delay() time.Duration {
+	return e.delay
+}
+
+// parseRetryAfter parses a Retry-After header in seconds or as an http date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// SetServiceRetryPolicy sets the retry policy of calls to a service,
+// nil disables retries for it.
+func (c *ServiceClient) SetServiceRetryPolicy(service string, policy *RetryPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retryPolicies[service] = policy
+}
+
+func (c *ServiceClient) retryPolicy(reqOpt *RequestParams) *RetryPolicy {
+	if reqOpt.Retry != nil {
+		return reqOpt.Retry
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if p, ok := c.retryPolicies[reqOpt.Service]; ok {
+		return p
+	}
+	return c.Retry
+}
+
+// sendWithRetry calls send until it succeeds or the policy gives up, and
+// returns the last response or error.
+func (c *ServiceClient) sendWithRetry(ctx context.Context, policy *RetryPolicy, reqOpt *RequestParams, prepared *preparedRequest) (*http.Response, error) {
+	backoff := policy.Backoff
+	if backoff == nil {
+		backoff = interval.Constant(0)
+	}
+
+	var resp *http.Response
+	var err error
+	ierr := interval.DoBackoff(ctx, policy.MaxAttempts, backoff, func(attempt int) (bool, error) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		resp, err = c.send(ctx, reqOpt, prepared)
+		if err != nil {
+			return ctx.Err() == nil, err
+		}
+		if !policy.retryable(resp.StatusCode) {
+			return false, nil
+		}
+		retry := &retryStatusError{status: resp.StatusCode}
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			if policy.MaxRetryAfter > 0 && d > policy.MaxRetryAfter {
+				d = policy.MaxRetryAfter
+			}
+			retry.delay = d
+			return true, retryAfterError{retry}
+		}
+		return true, retry
+	})
+
+	if ierr == context.Canceled || ierr == context.DeadlineExceeded {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, ierr
+	}
+	return resp, err
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/interval"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	if d, ok := parseRetryAfter("3"); !ok || d != 3*time.Second {
+		t.Errorf("seconds: got %s, %v", d, ok)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d, ok := parseRetryAfter(date); !ok || d <= 58*time.Second || d > time.Minute {
+		t.Errorf("date: got %s, %v", d, ok)
+	}
+	past := time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)
+	if d, ok := parseRetryAfter(past); !ok || d != 0 {
+		t.Errorf("past date: got %s, %v", d, ok)
+	}
+	for _, v := range []string{"", "-1", "soon"} {
+		if _, ok := parseRetryAfter(v); ok {
+			t.Errorf("%q: expected no delay", v)
+		}
+	}
+}
+
+// retryService answers with the statuses in order, repeating the last one,
+// and records the requests it got.
+type retryService struct {
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header
+	requests []*http.Request
+}
+
+func (s *retryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r)
+	status := s.statuses[0]
+	if len(s.statuses) > 1 {
+		s.statuses = s.statuses[1:]
+	}
+	for k, v := range s.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+}
+
+func (s *retryService) attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func newRetryClient(t *testing.T, s *retryService) *ServiceClient {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	registry := NewServiceRegistry()
+	registry.Register("orders", srv.URL)
+	return NewServiceClient(registry)
+}
+
+func TestRetryAttempts(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		method   string
+		key      string
+		attempts int
+		status   int
+	}{
+		{"retries until the limit", []int{503}, "GET", "", 3, 503},
+		{"stops on success", []int{502, 200}, "GET", "", 2, 200},
+		{"doesn't retry other statuses", []int{500}, "GET", "", 1, 500},
+		{"doesn't retry POST", []int{503}, "POST", "", 1, 503},
+		{"retries POST with an idempotency key", []int{503, 429, 201}, "POST", "order-1", 3, 201},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &retryService{statuses: tt.statuses}
+			c := newRetryClient(t, s)
+			policy := *DefaultRetryPolicy
+			policy.Backoff = interval.Constant(time.Millisecond)
+
+			resp, err := c.Do(context.Background(), &RequestParams{
+				Service: "orders", Path: "x", Method: tt.method, Retry: &policy, IdempotencyKey: tt.key,
+				Data: map[string]interface{}{"n": 1},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status || s.attempts() != tt.attempts {
+				t.Fatalf("got %d after %d attempts, want %d after %d", resp.StatusCode, s.attempts(), tt.status, tt.attempts)
+			}
+			for _, r := range s.requests {
+				if got := r.Header.Get(IdempotencyKeyHeader); got != tt.key {
+					t.Errorf("Idempotency-Key: got %q, want %q", got, tt.key)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		max        time.Duration
+		min        time.Duration
+	}{
+		{"seconds replace the backoff", "0", 0, 0},
+		{"seconds are capped", "60", 30 * time.Millisecond, 30 * time.Millisecond},
+		{"date is capped", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 30 * time.Millisecond, 30 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &retryService{statuses: []int{503, 200}, header: http.Header{"Retry-After": {tt.retryAfter}}}
+			c := newRetryClient(t, s)
+			policy := &RetryPolicy{
+				MaxAttempts:     2,
+				Backoff:         interval.Constant(time.Hour),
+				RetryableStatus: []int{503},
+				MaxRetryAfter:   tt.max,
+			}
+
+			start := time.Now()
+			resp, err := c.Do(context.Background(), &RequestParams{Service: "orders", Path: "x", Method: "GET", Retry: policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if elapsed := time.Since(start); resp.StatusCode != 200 || elapsed < tt.min || elapsed > 5*time.Second {
+				t.Fatalf("got %d after %s", resp.StatusCode, elapsed)
+			}
+		})
+	}
+}
+
+func TestRetryCancelledDuringBackoff(t *testing.T) {
+	s := &retryService{statuses: []int{503}}
+	c := newRetryClient(t, s)
+	policy := &RetryPolicy{MaxAttempts: 3, Backoff: interval.Constant(time.Hour), RetryableStatus: []int{503}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	resp, err := c.Do(ctx, &RequestParams{Service: "orders", Path: "x", Method: "GET", Retry: policy})
+	if resp != nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, %v, want the context error", resp, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second || s.attempts() != 1 {
+		t.Fatalf("%d attempts in %s", s.attempts(), elapsed)
+	}
+}
@@ -2,10 +2,11 @@ package common
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/ahmadIte99/hamdan_common/logging"
 )
 
 type Subscription struct {
@@ -77,7 +78,7 @@ func (cs *ClientSubscription) CheckSubscription(next http.Handler) http.Handler
 			if then.After(now) {
 				next.ServeHTTP(w, r)
 			} else {
-				http.Error(w, "Customer subscription expired", http.StatusBadRequest)
+				WriteError(w, r, NewAPIError(http.StatusBadRequest, "subscription_expired", "Customer subscription expired"))
 			}
 
 		} else {
@@ -89,17 +90,21 @@ func (cs *ClientSubscription) CheckSubscription(next http.Handler) http.Handler
 				Header:  headerParams,
 			}
 			resp, err := CallService(reqOpt)
-			fmt.Println("subscriptions error: ", err)
+			if err != nil {
+				logging.FromContext(r.Context()).Error("subscriptions call failed", "err", err)
+			} else {
+				defer resp.Body.Close()
+			}
 
 			if err != nil {
-				http.Error(w, "manager service down!", http.StatusInternalServerError)
+				WriteError(w, r, NewAPIError(http.StatusInternalServerError, "manager_unavailable", "manager service down!"))
 			} else if resp.StatusCode != 200 {
-				http.Error(w, "manager service not available", http.StatusBadRequest)
+				WriteError(w, r, NewAPIError(http.StatusBadRequest, "manager_unavailable", "manager service not available"))
 			} else {
 				var res Subscriptions
 				decodeErr := json.NewDecoder(resp.Body).Decode(&res)
 				if decodeErr != nil {
-					http.Error(w, "manager error decoding response", http.StatusBadRequest)
+					WriteError(w, r, NewAPIError(http.StatusBadRequest, "manager_bad_response", "manager error decoding response"))
 				} else {
 					//update list
 					for _, val := range res.Contents {
@@ -113,11 +118,11 @@ func (cs *ClientSubscription) CheckSubscription(next http.Handler) http.Handler
 						if then.After(now) {
 							next.ServeHTTP(w, r)
 						} else {
-							http.Error(w, "Customer subscription expired", http.StatusBadRequest)
+							WriteError(w, r, NewAPIError(http.StatusBadRequest, "subscription_expired", "Customer subscription expired"))
 						}
 
 					} else {
-						http.Error(w, "Client has no subscription", http.StatusBadRequest)
+						WriteError(w, r, NewAPIError(http.StatusBadRequest, "no_subscription", "Client has no subscription"))
 					}
 
 				}
@@ -140,15 +145,18 @@ func FetchSubscriptions(cs *ClientSubscription, c chan string) {
 		Header:  headerParams,
 	}
 	resp, err := CallService(reqOpt)
+	if err == nil {
+		defer resp.Body.Close()
+	}
 	if err != nil {
-		fmt.Println("manager service down!")
+		logging.Error("manager service down", "err", err)
 	} else if resp.StatusCode != 200 {
-		fmt.Println("manager service not available!")
+		logging.Error("manager service not available", "status", resp.StatusCode)
 	} else {
 		var res Subscriptions
 		decodeErr := json.NewDecoder(resp.Body).Decode(&res)
 		if decodeErr != nil {
-			fmt.Println("manager error decoding response")
+			logging.Error("manager error decoding response", "err", decodeErr)
 		} else {
 			//update list
 			for _, val := range res.Contents {
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ahmadIte99/hamdan_common/tracing"
+)
+
+// ServiceTokenSource issues service tokens from serviceAuth/issue/<service>
+// and caches them per target service until shortly before they expire.
+// Tokens are issued with Header only, never with the headers of the request
+// being served, so they are shared by every tenant and user.
+// Tokens inside the refresh window are still returned while a single
+// background call refreshes them.
+type ServiceTokenSource struct {
+	// Client issues the tokens, nil means DefaultServiceClient. A
+	// ServiceClient using the source issues them itself.
+	Client *ServiceClient
+	Header *HeaderParams
+	// RefreshBefore is how long before expiry the token is refreshed.
+	RefreshBefore time.Duration
+	// DefaultTTL is used when the expiry can't be read from the token
+	// (a JWT exp claim) or the response (expiresIn seconds or expire).
+	DefaultTTL time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*serviceToken
+}
+
+// serviceToken is the cached token of a target service.
+type serviceToken struct {
+	token    string
+	expires  time.Time
+	inflight *tokenCall
+}
+
+type tokenCall struct {
+	done    chan struct{}
+	token   string
+	expires time.Time
+	err     error
+}
+
+func NewServiceTokenSource(h *HeaderParams) *ServiceTokenSource {
+	return &ServiceTokenSource{
+		Header:        h,
+		RefreshBefore: time.Minute,
+		DefaultTTL:    5 * time.Minute,
+	}
+}
+
+// Token returns a valid token for calls to service, issuing a new one
+// when needed.
+func (s *ServiceTokenSource) Token(ctx context.Context, service string) (string, error) {
+	c := s.Client
+	if c == nil {
+		c = DefaultServiceClient
+	}
+	return s.token(ctx, c, service)
+}
+
+func (s *ServiceTokenSource) token(ctx context.Context, c *ServiceClient, service string) (string, error) {
+	now := time.Now()
+	s.mu.Lock()
+	if s.tokens == nil {
+		s.tokens = map[string]*serviceToken{}
+	}
+	t := s.tokens[service]
+	if t == nil {
+		t = &serviceToken{}
+		s.tokens[service] = t
+	}
+	if t.token != "" && now.Before(t.expires) {
+		token := t.token
+		if !now.Before(t.expires.Add(-s.RefreshBefore)) {
+			s.refresh(ctx, c, service, t)
+		}
+		s.mu.Unlock()
+		return token, nil
+	}
+	call := s.refresh(ctx, c, service, t)
+	s.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Invalidate drops the cached token of service, e.g. after it was rejected.
+func (s *ServiceTokenSource) Invalidate(service string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.tokens[service]; t != nil {
+		t.token = ""
+		t.expires = time.Time{}
+	}
+}
+
+// refresh starts issuing a token for service unless a call is already in
+// flight. The call is shared by every caller waiting for the token, so it
+// only keeps the trace of ctx: neither its cancellation nor the headers of
+// the caller, the token is issued with Header alone.
+// s.mu must be held.
+func (s *ServiceTokenSource) refresh(ctx context.Context, c *ServiceClient, service string, t *serviceToken) *tokenCall {
+	if t.inflight != nil {
+		return t.inflight
+	}
+	call := &tokenCall{done: make(chan struct{})}
+	t.inflight = call
+	issueCtx := context.Background()
+	if trace, ok := tracing.FromContext(ctx); ok {
+		issueCtx = tracing.WithTrace(issueCtx, trace)
+	}
+	go func() {
+		call.token, call.expires, call.err = s.issue(issueCtx, c, service)
+		s.mu.Lock()
+		if call.err == nil {
+			t.token = call.token
+			t.expires = call.expires
+		}
+		t.inflight = nil
+		s.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+func (s *ServiceTokenSource) issue(ctx context.Context, c *ServiceClient, service string) (string, time.Time, error) {
+	reqOpt := &RequestParams{
+		Service: "serviceAuth",
+		Path:    "issue/" + service,
+		Method:  "POST",
+		Data:    map[string]interface{}{},
+		Header:  s.Header,
+	}
+	var res struct {
+		Token     string
+		ExpiresIn int64
+		Expire    time.Time
+	}
+	if err := c.DoJSON(ctx, reqOpt, &res); err != nil {
+		return "", time.Time{}, fmt.Errorf("issue service token for %s: %w", service, err)
+	}
+	if res.Token == "" {
+		return "", time.Time{}, fmt.Errorf("issue service token for %s: empty token", service)
+	}
+
+	now := time.Now()
+	expires := now.Add(s.DefaultTTL)
+	switch {
+	case res.ExpiresIn > 0:
+		expires = now.Add(time.Duration(res.ExpiresIn) * time.Second)
+	case !res.Expire.IsZero():
+		expires = res.Expire
+	default:
+		if exp, ok := jwtExpiry(res.Token); ok {
+			expires = exp
+		}
+	}
+	return res.Token, expires, nil
+}
+
+// jwtExpiry reads the exp claim of a JWT without verifying it.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ahmadIte99/hamdan_common/tracing"
+)
+
+func TestServiceTokenSource(t *testing.T) {
+	var mu sync.Mutex
+	issued := map[string]int{}
+	reject := map[string]bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/issue/") {
+			service := strings.TrimPrefix(r.URL.Path, "/issue/")
+			issued[service]++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"token":     service + "-" + string(rune('0'+issued[service])),
+				"expiresIn": 3600,
+			})
+			return
+		}
+		token := r.Header.Get("x-service-token")
+		if reject[token] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(token))
+	}))
+	defer srv.Close()
+
+	registry := NewServiceRegistry()
+	for _, name := range []string{"serviceAuth", "users", "files"} {
+		registry.Register(name, srv.URL)
+	}
+	client := NewServiceClient(registry)
+	client.TokenSource = NewServiceTokenSource(nil)
+
+	call := func(service string) (int, string) {
+		resp, err := client.Do(context.Background(), &RequestParams{Service: service, Path: "x", Method: "GET"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if _, token := call("users"); token != "users-1" {
+		t.Fatalf("users: got %q", token)
+	}
+	if _, token := call("files"); token != "files-1" {
+		t.Fatalf("files: got %q", token)
+	}
+	if _, token := call("users"); token != "users-1" {
+		t.Fatalf("users: token not cached, got %q", token)
+	}
+
+	mu.Lock()
+	reject["users-1"] = true
+	mu.Unlock()
+	if status, _ := call("users"); status != http.StatusUnauthorized {
+		t.Fatalf("got %d, want 401", status)
+	}
+	if _, token := call("users"); token != "users-2" {
+		t.Fatalf("users: got %q after 401, want a new token", token)
+	}
+	if _, token := call("files"); token != "files-1" {
+		t.Fatalf("files: got %q, want the cached token", token)
+	}
+}
+
+func TestServiceTokenSourceIgnoresRequestHeaders(t *testing.T) {
+	var mu sync.Mutex
+	var issueHeaders []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/issue/") {
+			mu.Lock()
+			issueHeaders = append(issueHeaders, r.Header.Clone())
+			mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]interface{}{"token": "tok", "expiresIn": 3600})
+		}
+	}))
+	defer srv.Close()
+
+	registry := NewServiceRegistry()
+	registry.Register("serviceAuth", srv.URL)
+	registry.Register("users", srv.URL)
+	client := NewServiceClient(registry)
+	client.TokenSource = NewServiceTokenSource(&HeaderParams{Service: "billing"})
+
+	ctx := WithHeaderParams(context.Background(), &HeaderParams{Client: "tenantA", AccessToken: "userA-token", UserId: "userA"})
+	ctx = tracing.WithTrace(ctx, tracing.Trace{RequestId: "req-1", TraceParent: tracing.NewTraceParent()})
+	resp, err := client.Do(ctx, &RequestParams{Service: "users", Path: "x", Method: "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(issueHeaders) != 1 {
+		t.Fatalf("got %d issue calls", len(issueHeaders))
+	}
+	h := issueHeaders[0]
+	for _, name := range []string{"x-client", "x-access-token", "x-user-id"} {
+		if v := h.Get(name); v != "" {
+			t.Errorf("issue call sent %s: %q", name, v)
+		}
+	}
+	if h.Get("x-service") != "billing" || h.Get("x-request-id") != "req-1" {
+		t.Errorf("issue call headers: %v", h)
+	}
+}
+
+func TestGetServiceTokenError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	old, _ := DefaultServiceRegistry.Service("serviceAuth")
+	DefaultServiceRegistry.Register("serviceAuth", srv.URL)
+	defer DefaultServiceRegistry.RegisterService(old)
+
+	token, err := GetServiceToken("users", nil)
+	var serviceErr *ServiceError
+	if token != "" || !errors.As(err, &serviceErr) || serviceErr.StatusCode != http.StatusForbidden {
+		t.Errorf("got %q, %v", token, err)
+	}
+}
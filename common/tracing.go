@@ -0,0 +1,63 @@
+package common
+
+import (
+	"net/http"
+
+	"github.com/ahmadIte99/hamdan_common/tracing"
+)
+
+// RequestIdMiddleware takes the x-request-id of the request, or generates
+// one, continues the W3C trace from the traceparent header with a new span,
+// and stores both in the request context and headers so ExtractHeaderParams
+// and the outgoing calls forward them. The request id is echoed in the
+// response headers.
+func RequestIdMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t := tracing.ChildTrace(
+				r.Header.Get(tracing.RequestIdHeader),
+				r.Header.Get(tracing.TraceParentHeader),
+				r.Header.Get(tracing.TraceStateHeader),
+			)
+			if t.RequestId == "" {
+				t.RequestId = tracing.NewRequestId()
+			}
+			w.Header().Set(tracing.RequestIdHeader, t.RequestId)
+
+			r = r.Clone(tracing.WithTrace(r.Context(), t))
+			r.Header.Set(tracing.RequestIdHeader, t.RequestId)
+			r.Header.Set(tracing.TraceParentHeader, t.TraceParent)
+			if t.TraceState == "" {
+				r.Header.Del(tracing.TraceStateHeader)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// setTraceHeaders adds the request id and trace context of h, or of the
+// request context when h has none, to an outgoing request.
+func setTraceHeaders(req *http.Request, h *HeaderParams) {
+	var t tracing.Trace
+	if h != nil {
+		t = tracing.Trace{RequestId: h.RequestId, TraceParent: h.TraceParent, TraceState: h.TraceState}
+	}
+	if ct, ok := tracing.FromContext(req.Context()); ok {
+		if t.RequestId == "" {
+			t.RequestId = ct.RequestId
+		}
+		if t.TraceParent == "" {
+			t.TraceParent = ct.TraceParent
+			t.TraceState = ct.TraceState
+		}
+	}
+	if t.RequestId != "" {
+		req.Header.Set(tracing.RequestIdHeader, t.RequestId)
+	}
+	if t.TraceParent != "" {
+		req.Header.Set(tracing.TraceParentHeader, t.TraceParent)
+		if t.TraceState != "" {
+			req.Header.Set(tracing.TraceStateHeader, t.TraceState)
+		}
+	}
+}
@@ -8,4 +8,5 @@ require (
 	github.com/nats-io/nats-streaming-server v0.25.2 // indirect
 	github.com/nats-io/stan.go v0.10.3
 	go.mongodb.org/mongo-driver v1.10.3
+	gopkg.in/yaml.v3 v3.0.1
 )
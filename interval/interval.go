@@ -1,7 +1,9 @@
 package interval
 
 import (
+	"context"
 	"errors"
+	"math/rand"
 	"time"
 )
 
@@ -39,3 +41,72 @@ func Do(sec time.Duration, fn Func) error {
 func IsMaxRetries(err error) bool {
 	return err == errMaxRetriesReached
 }
+
+// Backoff returns how long to wait after the given failed attempt.
+type Backoff func(attempt int) time.Duration
+
+// Constant waits d between attempts.
+func Constant(d time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		return d
+	}
+}
+
+// Exponential doubles the wait from base after every attempt, up to max
+// when max is positive, with up to 20% random jitter.
+func Exponential(base time.Duration, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt; i++ {
+			d *= 2
+			if max > 0 && d >= max {
+				d = max
+				break
+			}
+		}
+		if d > 0 {
+			d += time.Duration(rand.Int63n(int64(d)/5 + 1))
+		}
+		if max > 0 && d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// Delayer can be implemented by errors returned from a Func to replace
+// the backoff wait before the next attempt, e.g. for a Retry-After header.
+type Delayer interface {
+	Delay() time.Duration
+}
+
+// DoBackoff is like Do with at most maxAttempts attempts (-1 for no limit),
+// waiting backoff(attempt) between them. It stops early with the context
+// error when ctx is done.
+func DoBackoff(ctx context.Context, maxAttempts int, backoff Backoff, fn Func) error {
+	var err error
+	var cont bool
+	attempt := 1
+	for {
+		cont, err = fn(attempt)
+		if !cont || err == nil {
+			break
+		}
+		if maxAttempts != -1 && attempt >= maxAttempts {
+			return errMaxRetriesReached
+		}
+		wait := backoff(attempt)
+		if d, ok := err.(Delayer); ok {
+			wait = d.Delay()
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		attempt++
+	}
+	return err
+}
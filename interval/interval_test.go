@@ -0,0 +1,88 @@
+package interval
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTry = errors.New("try again")
+
+type delayErr time.Duration
+
+func (d delayErr) Error() string {
+	return "delayed"
+}
+
+func (d delayErr) Delay() time.Duration {
+	return time.Duration(d)
+}
+
+func TestDoBackoffAttempts(t *testing.T) {
+	var waits []int
+	calls := 0
+	err := DoBackoff(context.Background(), 3, func(attempt int) time.Duration {
+		waits = append(waits, attempt)
+		return 0
+	}, func(attempt int) (bool, error) {
+		calls++
+		if attempt != calls {
+			t.Errorf("attempt %d on call %d", attempt, calls)
+		}
+		return true, errTry
+	})
+	if !IsMaxRetries(err) || calls != 3 || len(waits) != 2 {
+		t.Fatalf("got %v after %d calls and %v waits", err, calls, waits)
+	}
+}
+
+func TestDoBackoffStops(t *testing.T) {
+	calls := 0
+	err := DoBackoff(context.Background(), -1, Constant(0), func(attempt int) (bool, error) {
+		calls++
+		if calls == 5 {
+			return false, errTry
+		}
+		return true, errTry
+	})
+	if err != errTry || calls != 5 {
+		t.Fatalf("got %v after %d calls", err, calls)
+	}
+}
+
+func TestDoBackoffDelayer(t *testing.T) {
+	start := time.Now()
+	err := DoBackoff(context.Background(), 2, Constant(time.Hour), func(attempt int) (bool, error) {
+		if attempt == 2 {
+			return false, nil
+		}
+		return true, delayErr(time.Millisecond)
+	})
+	if err != nil || time.Since(start) > 5*time.Second {
+		t.Fatalf("got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestDoBackoffCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	calls := 0
+	err := DoBackoff(ctx, -1, Constant(time.Hour), func(attempt int) (bool, error) {
+		calls++
+		return true, errTry
+	})
+	if err != context.Canceled || calls != 1 {
+		t.Fatalf("got %v after %d calls", err, calls)
+	}
+}
+
+func TestExponential(t *testing.T) {
+	b := Exponential(10*time.Millisecond, 50*time.Millisecond)
+	for attempt, min := range []time.Duration{10, 20, 40, 50, 50} {
+		min *= time.Millisecond
+		if d := b(attempt + 1); d < min || d > min+min/5 || d > 50*time.Millisecond {
+			t.Errorf("attempt %d: got %s", attempt+1, d)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Package logging logs messages with key/value pairs through a Backend
+// writing text or JSON lines. The module logs with Default, configured by
+// the LOG_LEVEL and LOG_FORMAT environment variables, or with the request
+// scoped logger that WithContext stores and FromContext returns.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Field is a key/value pair attached to an entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Entry is one log record passed to a Backend.
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+// Backend writes entries, e.g. to a file or a log shipper.
+// It must be safe for concurrent use.
+type Backend interface {
+	Write(e Entry)
+}
+
+// Logger logs messages with key/value pairs, e.g.
+//
+//	logger.Error("batchdelete", "pattern", pattern, "err", err)
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+	// With returns a logger adding kv to every entry.
+	With(kv ...interface{}) Logger
+	Enabled(level Level) bool
+}
+
+type logger struct {
+	backend Backend
+	level   Level
+	fields  []Field
+}
+
+func New(backend Backend, level Level) Logger {
+	return &logger{backend: backend, level: level}
+}
+
+func (l *logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := make([]Field, len(l.fields), len(l.fields)+len(kv)/2)
+	copy(fields, l.fields)
+	l.backend.Write(Entry{Time: time.Now(), Level: level, Message: msg, Fields: appendFields(fields, kv)})
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *logger) With(kv ...interface{}) Logger {
+	fields := append([]Field(nil), l.fields...)
+	return &logger{backend: l.backend, level: l.level, fields: appendFields(fields, kv)}
+}
+
+// appendFields pairs kv into fields. A key without value is logged under "!BADKEY".
+func appendFields(fields []Field, kv []interface{}) []Field {
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 == len(kv) {
+			fields = append(fields, Field{Key: "!BADKEY", Value: kv[i]})
+			break
+		}
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		fields = append(fields, Field{Key: key, Value: kv[i+1]})
+	}
+	return fields
+}
+
+// fieldValue makes errors and Stringers readable in JSON output.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+type jsonBackend struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewJSONBackend writes one JSON object per entry to out.
+func NewJSONBackend(out io.Writer) Backend {
+	return &jsonBackend{out: out}
+}
+
+func (b *jsonBackend) Write(e Entry) {
+	m := make(map[string]interface{}, len(e.Fields)+3)
+	for _, f := range e.Fields {
+		m[f.Key] = fieldValue(f.Value)
+	}
+	m["time"] = e.Time.Format(time.RFC3339Nano)
+	m["level"] = e.Level.String()
+	m["msg"] = e.Message
+	line, err := json.Marshal(m)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"time": m["time"].(string), "level": e.Level.String(), "msg": e.Message, "logError": err.Error()})
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.out.Write(append(line, '\n'))
+}
+
+type textBackend struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewTextBackend writes entries as "time LEVEL msg key=value ..." lines to out.
+func NewTextBackend(out io.Writer) Backend {
+	return &textBackend{out: out}
+}
+
+func (b *textBackend) Write(e Entry) {
+	var sb strings.Builder
+	sb.WriteString(e.Time.Format(time.RFC3339))
+	sb.WriteByte(' ')
+	sb.WriteString(strings.ToUpper(e.Level.String()))
+	sb.WriteByte(' ')
+	sb.WriteString(e.Message)
+	for _, f := range e.Fields {
+		s := fmt.Sprint(fieldValue(f.Value))
+		if strings.ContainsAny(s, " \t\n\"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		sb.WriteByte(' ')
+		sb.WriteString(f.Key)
+		sb.WriteByte('=')
+		sb.WriteString(s)
+	}
+	sb.WriteByte('\n')
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	io.WriteString(b.out, sb.String())
+}
+
+// Discard drops every entry.
+var Discard Backend = discard{}
+
+type discard struct{}
+
+func (discard) Write(Entry) {}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger = newFromEnv()
+)
+
+// newFromEnv logs to stdout as text, or as JSON when LOG_FORMAT=json, at
+// the LOG_LEVEL level, info by default.
+func newFromEnv() Logger {
+	level, _ := ParseLevel(os.Getenv("LOG_LEVEL"))
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		return New(NewJSONBackend(os.Stdout), level)
+	}
+	return New(NewTextBackend(os.Stdout), level)
+}
+
+// Default returns the logger used by the module.
+func Default() Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultLogger
+}
+
+// SetDefault replaces the logger used by the module.
+func SetDefault(l Logger) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultLogger = l
+}
+
+func Debug(msg string, kv ...interface{}) { Default().Debug(msg, kv...) }
+func Info(msg string, kv ...interface{})  { Default().Info(msg, kv...) }
+func Warn(msg string, kv ...interface{})  { Default().Warn(msg, kv...) }
+func Error(msg string, kv ...interface{}) { Default().Error(msg, kv...) }
+
+type contextKey struct{}
+
+// WithContext returns a copy of ctx carrying l.
+func WithContext(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the request scoped logger of ctx, or Default.
+func FromContext(ctx context.Context) Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(Logger); ok {
+			return l
+		}
+	}
+	return Default()
+}
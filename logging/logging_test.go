@@ -0,0 +1,153 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder keeps the entries written to it.
+type recorder struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+func (r *recorder) Write(e Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, e)
+}
+
+func (r *recorder) messages() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var msgs []string
+	for _, e := range r.entries {
+		msgs = append(msgs, e.Message)
+	}
+	return msgs
+}
+
+func TestLevelFiltering(t *testing.T) {
+	rec := &recorder{}
+	l := New(rec, LevelWarn)
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error")
+
+	if got := rec.messages(); !reflect.DeepEqual(got, []string{"warn", "error"}) {
+		t.Fatalf("got %v", got)
+	}
+	if l.Enabled(LevelInfo) || !l.Enabled(LevelWarn) || !l.With("k", "v").Enabled(LevelError) {
+		t.Error("Enabled doesn't match the level")
+	}
+	if rec.entries[1].Level != LevelError {
+		t.Errorf("level: got %v", rec.entries[1].Level)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"debug": LevelDebug, "": LevelInfo, "INFO": LevelInfo, "warning": LevelWarn, "error": LevelError} {
+		if got, err := ParseLevel(s); err != nil || got != want {
+			t.Errorf("%q: got %v, %v", s, got, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestWithKeepsParentFields(t *testing.T) {
+	rec := &recorder{}
+	parent := New(rec, LevelDebug).With("service", "orders")
+	child := parent.With("userId", "u1")
+	sibling := parent.With("userId", "u2")
+
+	child.Info("child", "n", 1)
+	parent.Info("parent")
+	sibling.Info("sibling")
+
+	want := [][]Field{
+		{{"service", "orders"}, {"userId", "u1"}, {"n", 1}},
+		{{"service", "orders"}},
+		{{"service", "orders"}, {"userId", "u2"}},
+	}
+	for i, e := range rec.entries {
+		if !reflect.DeepEqual(e.Fields, want[i]) {
+			t.Errorf("%s: got %v, want %v", e.Message, e.Fields, want[i])
+		}
+	}
+}
+
+func TestBadKey(t *testing.T) {
+	rec := &recorder{}
+	New(rec, LevelInfo).Info("msg", "a", 1, 2, "b", "odd")
+
+	want := []Field{{"a", 1}, {"2", "b"}, {"!BADKEY", "odd"}}
+	if got := rec.entries[0].Fields; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestJSONBackend(t *testing.T) {
+	var buf bytes.Buffer
+	New(NewJSONBackend(&buf), LevelInfo).Error("failed", "err", errors.New("boom"), "took", time.Second, "n", 2)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("%q: %v", buf.String(), err)
+	}
+	if line["level"] != "error" || line["msg"] != "failed" || line["err"] != "boom" || line["took"] != "1s" || line["n"] != 2.0 {
+		t.Fatalf("got %v", line)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, line["time"].(string)); err != nil {
+		t.Errorf("time: %v", err)
+	}
+
+	buf.Reset()
+	New(NewJSONBackend(&buf), LevelInfo).Info("bad", "fn", func() {})
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil || line["msg"] != "bad" || line["logError"] == nil {
+		t.Fatalf("unencodable field: got %q", buf.String())
+	}
+}
+
+func TestTextBackend(t *testing.T) {
+	var buf bytes.Buffer
+	New(NewTextBackend(&buf), LevelInfo).Warn("slow call", "service", "orders", "err", errors.New("timed out"), "took", time.Second)
+
+	line := buf.String()
+	if !strings.HasSuffix(line, ` WARN slow call service=orders err="timed out" took=1s`+"\n") {
+		t.Fatalf("got %q", line)
+	}
+	if _, err := time.Parse(time.RFC3339, strings.SplitN(line, " ", 2)[0]); err != nil {
+		t.Errorf("time: %v", err)
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	old := Default()
+	defer SetDefault(old)
+	def := &recorder{}
+	SetDefault(New(def, LevelInfo))
+
+	FromContext(context.Background()).Info("default")
+	FromContext(nil).Info("nil context")
+	scoped := &recorder{}
+	ctx := WithContext(context.Background(), New(scoped, LevelInfo))
+	FromContext(ctx).Info("scoped")
+	Info("package")
+
+	if got := def.messages(); !reflect.DeepEqual(got, []string{"default", "nil context", "package"}) {
+		t.Errorf("default: got %v", got)
+	}
+	if got := scoped.messages(); !reflect.DeepEqual(got, []string{"scoped"}) {
+		t.Errorf("scoped: got %v", got)
+	}
+}
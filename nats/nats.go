@@ -1,10 +1,12 @@
 package nats
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"sync"
 
+	"github.com/ahmadIte99/hamdan_common/logging"
+	"github.com/ahmadIte99/hamdan_common/tracing"
 	stan "github.com/nats-io/stan.go"
 )
 
@@ -18,27 +20,124 @@ func Connect(cluster string, clientId string, url string) stan.Conn {
 	// once.Do(func() {
 	sc, err := stan.Connect(cluster, clientId, stan.NatsURL(url))
 	if err != nil {
-		fmt.Println("connect: ", err)
+		logging.Error("nats connect failed", "cluster", cluster, "clientId", clientId, "url", url, "err", err)
 	}
 	Client = sc
 	// })
 	return Client
 }
 
+// Publish publishes data JSON encoded. It carries no trace, use
+// PublishContext to continue the trace of a request.
 func Publish(topic string, data interface{}) {
 	if Client == nil {
-		err := fmt.Errorf("publish: there is no connected NATs client")
-		fmt.Println(err)
+		logging.Error("nats publish: there is no connected NATs client", "topic", topic)
 		return
 	}
 	j, _ := json.Marshal(data)
 	Client.Publish(topic, []byte(j))
 }
 
+// envelope wraps the data published by PublishContext with the trace of
+// the publisher:
+//
+//	{"_envelope": "trace/v1", "trace": {"x-request-id": "...", "traceparent": "...", "tracestate": "..."}, "data": <data>}
+//
+// Only messages marked with _envelope are unwrapped, so a payload of its own
+// with trace and data fields is delivered as is. Listen and ListenContext
+// unwrap it before calling back, other subscribers can use MsgData.
+type envelope struct {
+	Version string          `json:"_envelope"`
+	Trace   *traceFields    `json:"trace"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// envelopeVersion marks the envelopes written by PublishContext.
+const envelopeVersion = "trace/v1"
+
+type traceFields struct {
+	RequestId   string `json:"x-request-id,omitempty"`
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+}
+
+// PublishContext publishes data like Publish. When ctx carries a trace,
+// data is wrapped in an envelope with it, see MsgData and ContextFromMsg.
+func PublishContext(ctx context.Context, topic string, data interface{}) {
+	if Client == nil {
+		logging.FromContext(ctx).Error("nats publish: there is no connected NATs client", "topic", topic)
+		return
+	}
+	j, _ := json.Marshal(data)
+	if t, ok := tracing.FromContext(ctx); ok {
+		j, _ = json.Marshal(envelope{
+			Version: envelopeVersion,
+			Trace:   &traceFields{RequestId: t.RequestId, TraceParent: t.TraceParent, TraceState: t.TraceState},
+			Data:    j,
+		})
+	}
+	Client.Publish(topic, []byte(j))
+}
+
+// unwrap returns the envelope of data, if it is one.
+func unwrap(data []byte) (envelope, bool) {
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil || e.Version != envelopeVersion || e.Trace == nil {
+		return envelope{}, false
+	}
+	return e, true
+}
+
+// MsgData returns the data of a message, unwrapping the envelope added by
+// PublishContext.
+func MsgData(m *stan.Msg) []byte {
+	if e, ok := unwrap(m.Data); ok {
+		return e.Data
+	}
+	return m.Data
+}
+
+// TraceFromMsg returns the trace added to a message by PublishContext,
+// continued with a new span.
+func TraceFromMsg(m *stan.Msg) (tracing.Trace, bool) {
+	e, ok := unwrap(m.Data)
+	if !ok || (e.Trace.RequestId == "" && e.Trace.TraceParent == "") {
+		return tracing.Trace{}, false
+	}
+	return tracing.ChildTrace(e.Trace.RequestId, e.Trace.TraceParent, e.Trace.TraceState), true
+}
+
+// ContextFromMsg returns a context carrying the trace of a message, so
+// calls made while handling it stay in the same trace.
+func ContextFromMsg(m *stan.Msg) context.Context {
+	ctx := context.Background()
+	if t, ok := TraceFromMsg(m); ok {
+		ctx = tracing.WithTrace(ctx, t)
+	}
+	return ctx
+}
+
+// Listen subscribes callback to topic, with Data unwrapped by MsgData.
 func Listen(topic string, queue string, DurableName string, callback callback) {
+	subscribe(topic, queue, DurableName, func(m *stan.Msg) {
+		m.Data = MsgData(m)
+		callback(m)
+	})
+}
+
+// ListenContext subscribes like Listen, calling back with the context of
+// ContextFromMsg.
+func ListenContext(topic string, queue string, DurableName string, callback func(ctx context.Context, m *stan.Msg)) {
+	subscribe(topic, queue, DurableName, func(m *stan.Msg) {
+		ctx := ContextFromMsg(m)
+		m.Data = MsgData(m)
+		callback(ctx, m)
+	})
+}
+
+func subscribe(topic string, queue string, DurableName string, callback callback) {
 	if Client == nil {
-		err := fmt.Errorf("listen: there is no connected NATs client")
-		fmt.Println(err)
+		logging.Error("nats listen: there is no connected NATs client", "topic", topic)
 		return
 	}
 	Client.QueueSubscribe(topic, queue, func(m *stan.Msg) {
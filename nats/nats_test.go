@@ -0,0 +1,59 @@
+package nats
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ahmadIte99/hamdan_common/tracing"
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+)
+
+func msg(data string) *stan.Msg {
+	return &stan.Msg{MsgProto: pb.MsgProto{Data: []byte(data)}}
+}
+
+func TestEnvelope(t *testing.T) {
+	parent := tracing.NewTraceParent()
+	data, _ := json.Marshal(envelope{
+		Version: envelopeVersion,
+		Trace:   &traceFields{RequestId: "req", TraceParent: parent, TraceState: "k=v"},
+		Data:    json.RawMessage(`{"id":1}`),
+	})
+	m := msg(string(data))
+
+	if got := string(MsgData(m)); got != `{"id":1}` {
+		t.Errorf("data: got %s", got)
+	}
+	tr, ok := TraceFromMsg(m)
+	if !ok || tr.RequestId != "req" || tr.TraceState != "k=v" ||
+		tracing.TraceId(tr.TraceParent) != tracing.TraceId(parent) || tr.TraceParent == parent {
+		t.Errorf("trace: got %+v, %v", tr, ok)
+	}
+}
+
+func TestPlainMessage(t *testing.T) {
+	for _, data := range []string{`{"id":1}`, `{"data":1,"id":2}`, `[1,2]`, `"x"`,
+		`{"trace":{"source":"audit"},"data":{"id":1}}`,
+		`{"_envelope":"trace/v2","trace":{"x-request-id":"req"},"data":1}`} {
+		m := msg(data)
+		if got := string(MsgData(m)); got != data {
+			t.Errorf("%s: data got %s", data, got)
+		}
+		if _, ok := TraceFromMsg(m); ok {
+			t.Errorf("%s: unexpected trace", data)
+		}
+	}
+}
+
+func TestInvalidTraceParentDropsTraceState(t *testing.T) {
+	data, _ := json.Marshal(envelope{
+		Version: envelopeVersion,
+		Trace:   &traceFields{RequestId: "req", TraceParent: "garbage", TraceState: "k=v"},
+		Data:    json.RawMessage(`1`),
+	})
+	tr, ok := TraceFromMsg(msg(string(data)))
+	if !ok || tr.TraceState != "" || tracing.TraceId(tr.TraceParent) == "" {
+		t.Errorf("got %+v, %v", tr, ok)
+	}
+}
@@ -0,0 +1,109 @@
+// Package tracing carries the request id and W3C trace context of a
+// request across services.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	RequestIdHeader   = "x-request-id"
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+// Trace identifies a request. TraceParent is the W3C traceparent naming
+// the current service span, which becomes the parent of outgoing calls.
+type Trace struct {
+	RequestId   string
+	TraceParent string
+	TraceState  string
+}
+
+type contextKey struct{}
+
+// WithTrace returns a copy of ctx carrying t.
+func WithTrace(ctx context.Context, t Trace) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the trace stored in ctx by WithTrace.
+func FromContext(ctx context.Context) (Trace, bool) {
+	if ctx == nil {
+		return Trace{}, false
+	}
+	t, ok := ctx.Value(contextKey{}).(Trace)
+	return t, ok
+}
+
+// NewRequestId returns a random request id.
+func NewRequestId() string {
+	return randomHex(16)
+}
+
+// NewTraceParent starts a new sampled trace.
+func NewTraceParent() string {
+	return "00-" + randomHex(16) + "-" + randomHex(8) + "-01"
+}
+
+// ChildTraceParent returns a traceparent in the same trace as parent with a
+// new span id, or a new trace when parent is not valid.
+func ChildTraceParent(parent string) string {
+	traceId, _, flags, ok := ParseTraceParent(parent)
+	if !ok {
+		return NewTraceParent()
+	}
+	return "00-" + traceId + "-" + randomHex(8) + "-" + flags
+}
+
+// ChildTrace continues the incoming traceParent and traceState with a new
+// span. When traceParent is not valid a new trace is started and traceState,
+// which belongs to the incoming trace, is dropped.
+func ChildTrace(requestId string, traceParent string, traceState string) Trace {
+	if _, _, _, ok := ParseTraceParent(traceParent); !ok {
+		return Trace{RequestId: requestId, TraceParent: NewTraceParent()}
+	}
+	return Trace{RequestId: requestId, TraceParent: ChildTraceParent(traceParent), TraceState: traceState}
+}
+
+// ParseTraceParent splits a version 00 traceparent header.
+func ParseTraceParent(v string) (traceId string, spanId string, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return "", "", "", false
+	}
+	if !isHex(parts[1], 32) || !isHex(parts[2], 16) || !isHex(parts[3], 2) {
+		return "", "", "", false
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", "", false
+	}
+	return parts[1], parts[2], parts[3], true
+}
+
+// TraceId returns the trace id of a traceparent, or an empty string.
+func TraceId(traceParent string) string {
+	traceId, _, _, _ := ParseTraceParent(traceParent)
+	return traceId
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}